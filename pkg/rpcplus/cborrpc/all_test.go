@@ -0,0 +1,131 @@
+package cborrpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+	"github.com/shutej/flynn/pkg/rpcplus/internal/reflectcodec"
+	"github.com/shutej/flynn/pkg/rpcplus/rpctest"
+)
+
+func TestConformance(t *testing.T) {
+	rpctest.TestCodec(t, rpc.Codec{NewClientCodec: NewClientCodec, NewServerCodec: NewServerCodec})
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	var b bytes.Buffer
+	if err := reflectcodec.Encode(format.NewWriter(&b), v); err != nil {
+		t.Fatalf("encoding %#v: %v", v, err)
+	}
+	return b.Bytes()
+}
+
+func decode(b []byte, v interface{}) error {
+	return reflectcodec.Decode(format.NewReader(bufio.NewReader(bytes.NewReader(b))), v)
+}
+
+// Examples from appendix A of RFC 8949.
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{nil, []byte{0xf6}},
+		{false, []byte{0xf4}},
+		{0, []byte{0x00}},
+		{23, []byte{0x17}},
+		{24, []byte{0x18, 0x18}},
+		{1000, []byte{0x19, 0x03, 0xe8}},
+		{1000000, []byte{0x1a, 0x00, 0x0f, 0x42, 0x40}},
+		{uint64(18446744073709551615), []byte{0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{-1, []byte{0x20}},
+		{-1000, []byte{0x39, 0x03, 0xe7}},
+		{int64(math.MinInt64), []byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{1.1, []byte{0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a}},
+		{float32(100000.0), []byte{0xfa, 0x47, 0xc3, 0x50, 0x00}},
+		{"IETF", []byte{0x64, 0x49, 0x45, 0x54, 0x46}},
+		{[]byte{1, 2, 3, 4}, []byte{0x44, 0x01, 0x02, 0x03, 0x04}},
+		{[]int{1, 2, 3}, []byte{0x83, 0x01, 0x02, 0x03}},
+		{map[string]string{"a": "A"}, []byte{0xa1, 0x61, 0x61, 0x61, 0x41}},
+	}
+	for _, test := range tests {
+		if b := encode(t, test.v); !bytes.Equal(b, test.want) {
+			t.Errorf("%#v: got % x, want % x", test.v, b, test.want)
+		}
+		if test.v == nil {
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(test.v))
+		if err := decode(test.want, got.Interface()); err != nil {
+			t.Errorf("decoding % x: %v", test.want, err)
+		} else if !reflect.DeepEqual(got.Elem().Interface(), test.v) {
+			t.Errorf("decoding % x: got %#v, want %#v", test.want, got.Elem().Interface(), test.v)
+		}
+	}
+
+	decodes := []struct {
+		b    []byte
+		want interface{}
+	}{
+		{[]byte{0xf9, 0x3c, 0x00}, 1.0},
+		{[]byte{0xf9, 0xc4, 0x00}, -4.0},
+		{[]byte{0xf9, 0x00, 0x01}, 5.960464477539063e-8},
+		{[]byte{0xf9, 0x7c, 0x00}, math.Inf(1)},
+		{[]byte{0xf7}, nil},                                             // undefined
+		{[]byte{0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0}, int64(1363896240)}, // tagged
+		{[]byte{0x7f, 0x65, 0x73, 0x74, 0x72, 0x65, 0x61, 0x64, 0x6d, 0x69, 0x6e, 0x67, 0xff}, "streaming"},
+		{[]byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff}, []byte{1, 2, 3, 4, 5}},
+		{[]byte{0x9f, 0x01, 0x82, 0x02, 0x03, 0x9f, 0x04, 0x05, 0xff, 0xff},
+			[]interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{[]byte{0xbf, 0x61, 0x61, 0x01, 0x61, 0x62, 0x9f, 0x02, 0x03, 0xff, 0xff},
+			map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{[]byte{0xa2, 0x01, 0x02, 0x03, 0x04}, map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+	}
+	for _, test := range decodes {
+		var x interface{}
+		if err := decode(test.b, &x); err != nil {
+			t.Errorf("decoding % x: %v", test.b, err)
+		} else if !reflect.DeepEqual(x, test.want) {
+			t.Errorf("decoding % x: got %#v, want %#v", test.b, x, test.want)
+		}
+	}
+
+	// indefinite lengths into Go types
+	var args rpctest.Args
+	if err := decode([]byte{0xbf, 0x61, 0x41, 0x07, 0x61, 0x42, 0x08, 0xff}, &args); err != nil || args != (rpctest.Args{A: 7, B: 8}) {
+		t.Errorf("got %+v, %v", args, err)
+	}
+	var a []int
+	if err := decode([]byte{0x9f, 0x01, 0x02, 0xff}, &a); err != nil || !reflect.DeepEqual(a, []int{1, 2}) {
+		t.Errorf("got %v, %v", a, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var n uint
+	var typeErr *reflectcodec.TypeError
+	if err := decode([]byte{0x20}, &n); !errors.As(err, &typeErr) {
+		t.Errorf("negative into uint: expected a TypeError, got %v", err)
+	}
+	if err := decode([]byte{0x3b, 0x80, 0, 0, 0, 0, 0, 0, 0}, nil); err == nil {
+		t.Error("expected an error for an integer below MinInt64")
+	}
+	if err := decode([]byte{0x82, 0x01}, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated array: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := decode([]byte{0x82, 0x01, 0xff}, nil); err == nil {
+		t.Error("expected an error for a break in a definite length array")
+	}
+	if err := decode([]byte{0x7f, 0x41, 0x00, 0xff}, nil); err == nil {
+		t.Error("expected an error for a byte string chunk in a text string")
+	}
+	if err := decode([]byte{0x1c}, nil); err == nil {
+		t.Error("expected an error for reserved additional information")
+	}
+}
@@ -0,0 +1,289 @@
+package cborrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/shutej/flynn/pkg/rpcplus/internal/reflectcodec"
+)
+
+var format = reflectcodec.Format{
+	NewReader: func(r *bufio.Reader) reflectcodec.Reader { return reader{r} },
+	NewWriter: func(b *bytes.Buffer) reflectcodec.Writer { return writer{b} },
+}
+
+// Major types.
+const (
+	majorUint   = 0
+	majorNegint = 1
+	majorBytes  = 2
+	majorText   = 3
+	majorArray  = 4
+	majorMap    = 5
+	majorTag    = 6
+	majorSimple = 7
+)
+
+// Additional information of the initial byte.
+const (
+	info1          = 24 // followed by a 1-byte argument
+	info2          = 25
+	info4          = 26
+	info8          = 27
+	infoIndefinite = 31
+)
+
+// Simple values and floats, of major type 7.
+const (
+	simpleFalse     = 0xf4
+	simpleTrue      = 0xf5
+	simpleNull      = 0xf6
+	simpleUndefined = 0xf7
+	simpleFloat16   = 0xf9
+	simpleFloat32   = 0xfa
+	simpleFloat64   = 0xfb
+	simpleBreak     = 0xff
+)
+
+// writer writes CBOR with definite lengths, in the preferred serialization
+// of RFC 8949 but for floats, which keep their size.
+type writer struct {
+	b *bytes.Buffer
+}
+
+// head writes the initial byte of major type m with argument v.
+func (w writer) head(m byte, v uint64) {
+	var b [9]byte
+	b[0] = m << 5
+	switch {
+	case v < info1:
+		b[0] |= byte(v)
+		w.b.Write(b[:1])
+	case v <= math.MaxUint8:
+		b[0] |= info1
+		b[1] = byte(v)
+		w.b.Write(b[:2])
+	case v <= math.MaxUint16:
+		b[0] |= info2
+		binary.BigEndian.PutUint16(b[1:], uint16(v))
+		w.b.Write(b[:3])
+	case v <= math.MaxUint32:
+		b[0] |= info4
+		binary.BigEndian.PutUint32(b[1:], uint32(v))
+		w.b.Write(b[:5])
+	default:
+		b[0] |= info8
+		binary.BigEndian.PutUint64(b[1:], v)
+		w.b.Write(b[:9])
+	}
+}
+
+func (w writer) WriteNil() {
+	w.b.WriteByte(simpleNull)
+}
+
+func (w writer) WriteBool(v bool) {
+	if v {
+		w.b.WriteByte(simpleTrue)
+	} else {
+		w.b.WriteByte(simpleFalse)
+	}
+}
+
+func (w writer) WriteInt(v int64) {
+	if v >= 0 {
+		w.head(majorUint, uint64(v))
+	} else {
+		w.head(majorNegint, uint64(-1-v))
+	}
+}
+
+func (w writer) WriteUint(v uint64) {
+	w.head(majorUint, v)
+}
+
+func (w writer) WriteFloat32(v float32) {
+	var b [5]byte
+	b[0] = simpleFloat32
+	binary.BigEndian.PutUint32(b[1:], math.Float32bits(v))
+	w.b.Write(b[:])
+}
+
+func (w writer) WriteFloat64(v float64) {
+	var b [9]byte
+	b[0] = simpleFloat64
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+	w.b.Write(b[:])
+}
+
+func (w writer) WriteString(v string) {
+	w.head(majorText, uint64(len(v)))
+	w.b.WriteString(v)
+}
+
+func (w writer) WriteBytes(v []byte) {
+	w.head(majorBytes, uint64(len(v)))
+	w.b.Write(v)
+}
+
+func (w writer) WriteArrayHeader(n int) {
+	w.head(majorArray, uint64(n))
+}
+
+func (w writer) WriteMapHeader(n int) {
+	w.head(majorMap, uint64(n))
+}
+
+// reader reads CBOR, including indefinite lengths.  Tags are ignored, the
+// tagged item being read in their place, and undefined is read as null.
+type reader struct {
+	r *bufio.Reader
+}
+
+var errMalformed = errors.New("cborrpc: malformed item")
+
+// maxLen is the largest length of an array or map.
+const maxLen = math.MaxInt32
+
+// head reads an initial byte and its argument.
+func (r reader) head() (major, info byte, v uint64, err error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = c>>5, c&0x1f
+	var n int
+	switch {
+	case info < info1:
+		return major, info, uint64(info), nil
+	case info <= info8:
+		n = 1 << (info - info1)
+	case info == infoIndefinite && major >= majorBytes && major != majorTag:
+		return major, info, 0, nil
+	default:
+		return 0, 0, 0, errMalformed
+	}
+	var b [8]byte
+	if _, err := io.ReadFull(r.r, b[8-n:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, 0, err
+	}
+	return major, info, binary.BigEndian.Uint64(b[:]), nil
+}
+
+func (r reader) Next() (reflectcodec.Token, error) {
+	for {
+		major, info, v, err := r.head()
+		if err != nil {
+			return reflectcodec.Token{}, err
+		}
+		switch major {
+		case majorUint:
+			return reflectcodec.Token{Kind: reflectcodec.Uint, Uint: v}, nil
+		case majorNegint:
+			if v > math.MaxInt64 {
+				return reflectcodec.Token{}, fmt.Errorf("cborrpc: integer -1-%d out of range", v)
+			}
+			return reflectcodec.Token{Kind: reflectcodec.Int, Int: -1 - int64(v)}, nil
+		case majorBytes, majorText:
+			kind := reflectcodec.Bytes
+			if major == majorText {
+				kind = reflectcodec.String
+			}
+			b, err := r.bytes(major, info, v)
+			return reflectcodec.Token{Kind: kind, Bytes: b}, err
+		case majorArray, majorMap:
+			kind := reflectcodec.Array
+			if major == majorMap {
+				kind = reflectcodec.Map
+			}
+			n := -1
+			if info != infoIndefinite {
+				if v > maxLen {
+					return reflectcodec.Token{}, errMalformed
+				}
+				n = int(v)
+			}
+			return reflectcodec.Token{Kind: kind, Len: n}, nil
+		case majorTag:
+			continue
+		}
+		switch c := majorSimple<<5 | info; c {
+		case simpleFalse, simpleTrue:
+			return reflectcodec.Token{Kind: reflectcodec.Bool, Bool: c == simpleTrue}, nil
+		case simpleNull, simpleUndefined:
+			return reflectcodec.Token{Kind: reflectcodec.Nil}, nil
+		case simpleFloat16:
+			return reflectcodec.Token{Kind: reflectcodec.Float, Float: float16(uint16(v))}, nil
+		case simpleFloat32:
+			return reflectcodec.Token{Kind: reflectcodec.Float, Float: float64(math.Float32frombits(uint32(v)))}, nil
+		case simpleFloat64:
+			return reflectcodec.Token{Kind: reflectcodec.Float, Float: math.Float64frombits(v)}, nil
+		case simpleBreak:
+			return reflectcodec.Token{Kind: reflectcodec.Break}, nil
+		}
+		return reflectcodec.Token{}, fmt.Errorf("cborrpc: unsupported simple value %d", v)
+	}
+}
+
+// bytes reads the contents of a byte or text string, concatenating the
+// chunks of an indefinite length one.
+func (r reader) bytes(major, info byte, n uint64) ([]byte, error) {
+	if info != infoIndefinite {
+		return reflectcodec.ReadBytes(r.r, n)
+	}
+	var b []byte
+	for {
+		c, err := r.r.ReadByte()
+		if err == nil && c == simpleBreak {
+			return b, nil
+		}
+		if err == nil {
+			err = r.r.UnreadByte()
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		m, info, n, err := r.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || info == infoIndefinite || uint64(len(b))+n > reflectcodec.MaxBytes {
+			return nil, errMalformed
+		}
+		chunk, err := reflectcodec.ReadBytes(r.r, n)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+// float16 decodes an IEEE 754 half-precision float.
+func float16(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp, frac := int(h>>10&0x1f), float64(h&0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
@@ -6,19 +6,24 @@ package rpcplus
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ServerError represents an error that has been returned from
-// the remote side of the RPC connection.
+// the remote side of the RPC connection.  Errors that carry a code
+// or details are returned as *Error instead.
 type ServerError string
 
 func (e ServerError) Error() string {
@@ -27,6 +32,10 @@ func (e ServerError) Error() string {
 
 var ErrShutdown = errors.New("connection is shut down")
 
+// ErrStreamClosed is returned by Call.Send and Call.CloseSend once the call
+// has completed.
+var ErrStreamClosed = errors.New("rpc: stream is closed")
+
 // Call represents an active RPC.
 type Call struct {
 	ServiceMethod string      // The name of the service and method to call.
@@ -36,9 +45,18 @@ type Call struct {
 	Done          chan *Call  // Strobes when call is complete (nil for streaming RPCs)
 	Stream        bool        // True for a streaming RPC call, false otherwise
 
-	seq    uint64
-	sent   chan struct{}
-	client *Client
+	Metadata         map[string]string // Sent with the request (see WithMetadata).
+	ResponseMetadata map[string]string // After completion, the metadata set by the server.
+
+	seq        uint64
+	sent       chan struct{}
+	client     *Client
+	deadline   time.Time     // sent to the server, zero if none
+	finished   chan struct{} // closed on completion, nil unless watched
+	sendStream bool          // the arguments are sent with Send and CloseSend
+	replies    *valueQueue   // delivers the replies of a stream to Reply
+	window     uint32        // flow control window of a stream, 0 if none
+	consumed   uint32        // replies taken from Reply since credit was last returned
 }
 
 // CloseStream closes the associated stream
@@ -47,19 +65,88 @@ func (c *Call) CloseStream() error {
 		return errors.New("rpc: cannot close non-stream request")
 	}
 	<-c.sent
-	c.client.sending.Lock()
-	defer c.client.sending.Unlock()
+	return c.client.writeCloseStream(c.seq)
+}
+
+// Send sends a value to a method receiving a stream of arguments.  It is
+// only valid for calls started with SendStreamGo or BidiStreamGo.
+func (c *Call) Send(value interface{}) error {
+	if !c.sendStream {
+		return errors.New("rpc: cannot send on a call that does not stream its arguments")
+	}
+	<-c.sent
+	return c.client.writeStreamRequest(c, streamSendServiceMethod, 0, value)
+}
+
+// CloseSend tells the server that no more values will be sent: the
+// method's channel is closed once it has received the values sent so far.
+func (c *Call) CloseSend() error {
+	if !c.sendStream {
+		return errors.New("rpc: cannot close send on a call that does not stream its arguments")
+	}
+	<-c.sent
+	return c.client.writeStreamRequest(c, closeSendServiceMethod, 0, struct{}{})
+}
 
-	c.client.mutex.Lock()
-	if c.client.shutdown {
-		c.client.mutex.Unlock()
+// writeCloseStream tells the server to stop the call with the given
+// sequence number.
+func (client *Client) writeCloseStream(seq uint64) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	client.mutex.Lock()
+	if client.shutdown {
+		client.mutex.Unlock()
 		return ErrShutdown
 	}
-	c.client.mutex.Unlock()
+	client.mutex.Unlock()
 
-	c.client.request.ServiceMethod = "CloseStream"
-	c.client.request.Seq = c.seq
-	return c.client.codec.WriteRequest(&c.client.request, struct{}{})
+	client.request.ServiceMethod = CloseStreamServiceMethod
+	client.request.Seq = seq
+	client.request.Deadline = time.Time{}
+	client.request.Window = 0
+	client.request.Metadata = nil
+	return client.codec.WriteRequest(&client.request, struct{}{})
+}
+
+// writeStreamRequest sends a request controlling the streams of call, as
+// long as the call is in progress.
+func (client *Client) writeStreamRequest(call *Call, serviceMethod string, window uint32, body interface{}) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	client.mutex.Lock()
+	if client.shutdown {
+		client.mutex.Unlock()
+		return ErrShutdown
+	}
+	if client.pending[call.seq] != call {
+		client.mutex.Unlock()
+		return ErrStreamClosed
+	}
+	client.mutex.Unlock()
+
+	client.request.ServiceMethod = serviceMethod
+	client.request.Seq = call.seq
+	client.request.Deadline = time.Time{}
+	client.request.Window = window
+	client.request.Metadata = nil
+	return client.codec.WriteRequest(&client.request, body)
+}
+
+// delivered returns credit to the server for the replies taken from the
+// channel of a stream, half a window at a time.
+func (call *Call) delivered() {
+	if call.window == 0 {
+		return
+	}
+	call.consumed++
+	if call.consumed < (call.window+1)/2 {
+		return
+	}
+	n := call.consumed
+	call.consumed = 0
+	call.client.writeStreamRequest(call, streamCreditServiceMethod, n, struct{}{})
 }
 
 // Client represents an RPC Client.
@@ -67,7 +154,7 @@ func (c *Call) CloseStream() error {
 // with a single Client, and a Client may be used by
 // multiple goroutines simultaneously.
 type Client struct {
-	mutex    sync.Mutex // protects pending, seq, request
+	mutex    sync.Mutex // protects pending, seq, request, streamWindow
 	sending  sync.Mutex
 	request  Request
 	seq      uint64
@@ -75,6 +162,10 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool
 	shutdown bool
+	draining bool          // the server asked for no new requests
+	closed   chan struct{} // closed once shutdown is set
+
+	streamWindow uint32
 }
 
 // A ClientCodec implements writing of RPC requests and
@@ -99,23 +190,29 @@ func (client *Client) send(call *Call) {
 
 	// Register this call.
 	client.mutex.Lock()
-	if client.shutdown {
+	if client.shutdown || client.draining {
 		call.Error = ErrShutdown
 		client.mutex.Unlock()
+		if call.sent != nil {
+			close(call.sent)
+		}
 		call.done()
 		return
 	}
 	seq := client.seq
 	client.seq++
 	client.pending[seq] = call
+	call.seq = seq
 	client.mutex.Unlock()
 
 	// Encode and send the request.
 	client.request.Seq = seq
 	client.request.ServiceMethod = call.ServiceMethod
+	client.request.Deadline = call.deadline
+	client.request.Window = call.window
+	client.request.Metadata = call.Metadata
 	err := client.codec.WriteRequest(&client.request, call.Args)
-	if call.Stream {
-		call.seq = seq
+	if call.sent != nil {
 		close(call.sent)
 	}
 	if err != nil {
@@ -137,15 +234,39 @@ func (client *Client) input() {
 		response = Response{}
 		err = client.codec.ReadResponseHeader(&response)
 		if err != nil {
-			if err == io.EOF && !client.closing {
+			if err == io.EOF && !client.closing && !client.draining {
 				err = io.ErrUnexpectedEOF
 			}
 			break
 		}
+		if response.Seq == GoAwaySeq && response.ServiceMethod == GoAwayServiceMethod {
+			// The server is shutting down: calls in flight
+			// complete, new ones fail with ErrShutdown.
+			client.mutex.Lock()
+			client.draining = true
+			client.mutex.Unlock()
+			err = client.codec.ReadResponseBody(nil)
+			continue
+		}
 		seq := response.Seq
 		client.mutex.Lock()
 		call := client.pending[seq]
+		if call != nil && (response.Error != "" || !call.Stream) {
+			// This response completes the call: take it from
+			// pending before decoding into its reply, so that
+			// an abandoned call is completed by abandon alone
+			// and its reply is left untouched.
+			delete(client.pending, seq)
+		}
 		client.mutex.Unlock()
+		if call != nil && response.Metadata != nil {
+			if call.ResponseMetadata == nil {
+				call.ResponseMetadata = make(map[string]string)
+			}
+			for k, v := range response.Metadata {
+				call.ResponseMetadata[k] = v
+			}
+		}
 
 		switch {
 		case call == nil:
@@ -162,43 +283,51 @@ func (client *Client) input() {
 			// We've got an error response. Give this to the request;
 			// any subsequent requests will get the ReadResponseBody
 			// error if there is one.
-			if !(call.Stream && response.Error == lastStreamResponseError) {
-				call.Error = ServerError(response.Error)
+			if !(call.Stream && response.Error == EndOfStream) {
+				call.Error = response.serverError()
 			}
 			err = client.codec.ReadResponseBody(nil)
 			if err != nil {
 				err = errors.New("reading error payload: " + err.Error())
 			}
-			client.done(seq)
+			call.done()
 		case call.Stream:
 			// call.Reply is a chan *T2
 			// we need to create a T2 and get a *T2 back
-			value := reflect.New(reflect.TypeOf(call.Reply).Elem().Elem()).Interface()
-			err = client.codec.ReadResponseBody(value)
+			value := reflect.New(reflect.TypeOf(call.Reply).Elem().Elem())
+			err = client.codec.ReadResponseBody(value.Interface())
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
-			} else {
-				// writing on the channel could block forever. For
-				// instance, if a client calls 'close', this might block
-				// forever.  the current suggestion is for the
-				// client to drain the receiving channel in that case
-				reflect.ValueOf(call.Reply).Send(reflect.ValueOf(value))
+			} else if call.window == 0 {
+				// without flow control, a slow reader holds
+				// up the connection
+				call.replies.pushWait(value)
+			} else if !call.replies.push(value) {
+				// the server stops sending once the window
+				// is used up: it ignores credit
+				client.abandon(call, errors.New("rpc: server sent more replies than the stream window"))
 			}
 		default:
 			err = client.codec.ReadResponseBody(call.Reply)
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
 			}
-			client.done(seq)
+			call.done()
 		}
 	}
 	// Terminate pending calls.
 	client.sending.Lock()
 	client.mutex.Lock()
 	client.shutdown = true
-	closing := client.closing
+	close(client.closed)
+	closing := client.closing || client.draining
 	for _, call := range client.pending {
 		call.Error = err
+		if call.Stream && client.closing {
+			// closed by the caller, who does not wait for
+			// the replies not delivered yet
+			call.replies.stop()
+		}
 		call.done()
 	}
 	client.mutex.Unlock()
@@ -208,21 +337,35 @@ func (client *Client) input() {
 	}
 }
 
-func (client *Client) done(seq uint64) {
+// abandon completes call with err if it is still pending and tells the
+// server to stop working on it.
+func (client *Client) abandon(call *Call, err error) {
 	client.mutex.Lock()
-	call := client.pending[seq]
-	delete(client.pending, seq)
+	if client.pending[call.seq] != call {
+		// already completed
+		client.mutex.Unlock()
+		return
+	}
+	delete(client.pending, call.seq)
 	client.mutex.Unlock()
 
-	if call != nil {
-		call.done()
+	call.Error = err
+	if call.Stream {
+		// nobody waits for the replies not delivered yet
+		call.replies.stop()
 	}
+	call.done()
+	client.writeCloseStream(call.seq)
 }
 
 func (call *Call) done() {
+	if call.finished != nil {
+		close(call.finished)
+	}
 	if call.Stream {
-		// need to close the channel. Client won't be able to read any more.
-		reflect.ValueOf(call.Reply).Close()
+		// need to close the channel once the queued replies have been
+		// read. Client won't be able to read any more.
+		call.replies.close()
 		return
 	}
 
@@ -241,9 +384,7 @@ func (call *Call) done() {
 // It adds a buffer to the write side of the connection so
 // the header and payload are sent as a unit.
 func NewClient(conn io.ReadWriteCloser) *Client {
-	encBuf := bufio.NewWriter(conn)
-	client := &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(encBuf), encBuf}
-	return NewClientWithCodec(client)
+	return NewClientWithCodec(newGobClientCodec(conn))
 }
 
 // NewClientWithCodec is like NewClient but uses the specified
@@ -252,6 +393,7 @@ func NewClientWithCodec(codec ClientCodec) *Client {
 	client := &Client{
 		codec:   codec,
 		pending: make(map[uint64]*Call),
+		closed:  make(chan struct{}),
 	}
 	go client.input()
 	return client
@@ -288,24 +430,28 @@ func (c *gobClientCodec) Close() error {
 
 // DialHTTP connects to an HTTP RPC server at the specified network address
 // listening on the default HTTP RPC path.
-func DialHTTP(network, address string) (*Client, error) {
-	return DialHTTPPath(network, address, DefaultRPCPath, nil)
+func DialHTTP(network, address string, opts ...DialOption) (*Client, error) {
+	return DialHTTPPath(network, address, DefaultRPCPath, nil, opts...)
 }
 
 type DialFunc func(network, address string) (net.Conn, error)
 
 // DialHTTPPath connects to an HTTP RPC server
 // at the specified network address and path.
-func DialHTTPPath(network, address, path string, dial DialFunc) (*Client, error) {
+func DialHTTPPath(network, address, path string, dial DialFunc, opts ...DialOption) (*Client, error) {
 	if dial == nil {
 		dial = net.Dial
 	}
+	var header http.Header
+	if newDialOptions(opts).compress {
+		header = http.Header{"Accept-Encoding": {FlateEncoding}}
+	}
 	var err error
 	conn, err := dial(network, address)
 	if err != nil {
 		return nil, err
 	}
-	client, err := NewHTTPClient(conn, path, nil)
+	client, err := NewHTTPClient(conn, path, header)
 	if err != nil {
 		conn.Close()
 		return nil, &net.OpError{
@@ -318,11 +464,19 @@ func DialHTTPPath(network, address, path string, dial DialFunc) (*Client, error)
 	return client, nil
 }
 
+// NewHTTPClient connects to an HTTP RPC server over conn, asking with
+// CONNECT for path.  Unless header sets it already, the Accept header
+// lists every registered codec, and the client uses the one given by the
+// Content-Type of the response: gob if there is none.  If header asks for
+// FlateEncoding with Accept-Encoding and the server agrees, the connection
+// is compressed.
 func NewHTTPClient(conn io.ReadWriteCloser, path string, header http.Header) (*Client, error) {
 	if header == nil {
 		header = make(http.Header)
 	}
-	header.Set("Accept", "application/vnd.flynn.rpc-hijack+gob")
+	if header.Get("Accept") == "" {
+		header.Set("Accept", strings.Join(MediaTypes(), ", "))
+	}
 
 	fmt.Fprintf(conn, "CONNECT %s HTTP/1.0\r\n", path)
 	header.Write(conn)
@@ -337,18 +491,45 @@ func NewHTTPClient(conn io.ReadWriteCloser, path string, header http.Header) (*C
 		}
 		return nil, err
 	}
-	return NewClient(conn), nil
+	mediaType := GobMediaType
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, err
+		}
+	}
+	codec, ok := LookupCodec(mediaType)
+	if !ok {
+		return nil, errors.New("rpc: no codec registered for " + mediaType)
+	}
+	switch encoding := resp.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case FlateEncoding:
+		conn = NewFlateConn(conn)
+	default:
+		return nil, errors.New("rpc: unsupported content encoding " + encoding)
+	}
+	return NewClientWithCodec(codec.NewClientCodec(conn)), nil
 }
 
 // Dial connects to an RPC server at the specified network address.
-func Dial(network, address string) (*Client, error) {
+func Dial(network, address string, opts ...DialOption) (*Client, error) {
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
+	if newDialOptions(opts).compress {
+		return NewClient(NewFlateConn(conn)), nil
+	}
 	return NewClient(conn), nil
 }
 
+// CloseNotify returns a channel that is closed once the connection is shut
+// down, whether by Close or because it failed.  It is closed before the
+// calls in flight are given their error.
+func (client *Client) CloseNotify() <-chan struct{} {
+	return client.closed
+}
+
 func (client *Client) Close() error {
 	client.mutex.Lock()
 	if client.shutdown || client.closing {
@@ -360,11 +541,55 @@ func (client *Client) Close() error {
 	return client.codec.Close()
 }
 
+// GoContext is like Go but the call is bound to ctx.  The deadline and
+// metadata of ctx, if any, are sent to the server.  If ctx is done before
+// the reply arrives, the call is abandoned: it completes with ctx.Err() and
+// the server is told to cancel it.
+func (client *Client) GoContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	client.sendContext(ctx, call)
+	return call
+}
+
+// StreamGoContext is like StreamGo but the call is bound to ctx, as with
+// GoContext.
+func (client *Client) StreamGoContext(ctx context.Context, serviceMethod string, args interface{}, replyStream interface{}) *Call {
+	call := client.newStreamCall(serviceMethod, args, replyStream)
+	client.sendContext(ctx, call)
+	return call
+}
+
+// sendContext sends call with the deadline and metadata of ctx, and
+// abandons it if ctx is done first.
+func (client *Client) sendContext(ctx context.Context, call *Call) {
+	call.deadline, _ = ctx.Deadline()
+	call.Metadata = outgoingMetadata(ctx)
+	if ctx.Done() == nil {
+		client.send(call)
+		return
+	}
+	call.finished = make(chan struct{})
+	client.send(call)
+	go func() {
+		select {
+		case <-call.finished:
+		case <-ctx.Done():
+			client.abandon(call, ctx.Err())
+		}
+	}()
+}
+
 // Go invokes the function asynchronously.  It returns the Call structure representing
 // the invocation.  The done channel will signal when the call is complete by returning
 // the same Call object.  If done is nil, Go will allocate a new channel.
 // If non-nil, done must be buffered or Go will deliberately crash.
 func (client *Client) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	client.send(call)
+	return call
+}
+
+func newCall(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
 	call := new(Call)
 	call.ServiceMethod = serviceMethod
 	call.Args = args
@@ -381,13 +606,42 @@ func (client *Client) Go(serviceMethod string, args interface{}, reply interface
 		}
 	}
 	call.Done = done
-	client.send(call)
 	return call
 }
 
 // Go invokes the streaming function asynchronously.  It returns the Call structure representing
 // the invocation.
 func (client *Client) StreamGo(serviceMethod string, args interface{}, replyStream interface{}) *Call {
+	call := client.newStreamCall(serviceMethod, args, replyStream)
+	client.send(call)
+	return call
+}
+
+// SendStreamGo invokes a function receiving a stream of arguments
+// asynchronously.  The arguments are sent with the Send method of the
+// returned Call and ended with CloseSend; completion is signalled on done
+// as with Go.
+func (client *Client) SendStreamGo(serviceMethod string, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, struct{}{}, reply, done)
+	call.sendStream = true
+	call.sent = make(chan struct{})
+	call.client = client
+	client.send(call)
+	return call
+}
+
+// BidiStreamGo invokes a function that receives a stream of arguments and
+// sends a stream of replies.  The arguments are sent with the Send method
+// of the returned Call while the replies arrive on replyStream as with
+// StreamGo.
+func (client *Client) BidiStreamGo(serviceMethod string, replyStream interface{}) *Call {
+	call := client.newStreamCall(serviceMethod, struct{}{}, replyStream)
+	call.sendStream = true
+	client.send(call)
+	return call
+}
+
+func (client *Client) newStreamCall(serviceMethod string, args interface{}, replyStream interface{}) *Call {
 	// first check the replyStream object is a stream of pointers to a data structure
 	typ := reflect.TypeOf(replyStream)
 	// FIXME: check the direction of the channel, maybe?
@@ -403,12 +657,39 @@ func (client *Client) StreamGo(serviceMethod string, args interface{}, replyStre
 	call.Stream = true
 	call.sent = make(chan struct{})
 	call.client = client
-	client.send(call)
+	client.mutex.Lock()
+	call.window = client.streamWindow
+	client.mutex.Unlock()
+	limit := int(call.window)
+	if limit == 0 {
+		limit = 1
+	}
+	call.replies = newValueQueue(reflect.ValueOf(replyStream), limit, call.delivered)
 	return call
 }
 
+// SetStreamWindow sets the number of replies the server may send on
+// streams started afterwards before they are read from the reply channel.
+// A slow reader then only holds up its own stream.  DefaultStreamWindow
+// suits most streams.  The server must support flow control, as servers of
+// this version do: older ones fail the stream once credit is returned.  The
+// default, 0, disables flow control: a slow reader then holds up every call
+// of the client.
+func (client *Client) SetStreamWindow(n uint32) {
+	client.mutex.Lock()
+	client.streamWindow = n
+	client.mutex.Unlock()
+}
+
 // Call invokes the named function, waits for it to complete, and returns its error status.
 func (client *Client) Call(serviceMethod string, args interface{}, reply interface{}) error {
 	call := <-client.Go(serviceMethod, args, reply, make(chan *Call, 1)).Done
 	return call.Error
 }
+
+// CallContext is like Call but returns ctx.Err() if ctx is done before the
+// call completes.  See GoContext.
+func (client *Client) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	call := <-client.GoContext(ctx, serviceMethod, args, reply, make(chan *Call, 1)).Done
+	return call.Error
+}
@@ -0,0 +1,84 @@
+package rpcplus
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// GobMediaType is the media type of the gob codec used by ServeConn and
+// NewClient, registered by this package.
+const GobMediaType = "application/vnd.flynn.rpc-hijack+gob"
+
+// A Codec is a wire format, registered with RegisterCodec under its media
+// type so that clients and servers can agree on one when connecting over
+// HTTP.
+type Codec struct {
+	NewClientCodec func(conn io.ReadWriteCloser) ClientCodec
+	NewServerCodec func(conn io.ReadWriteCloser) ServerCodec
+
+	// Text is true for codecs writing UTF-8 text only, which transports
+	// such as WebSocket may carry in text messages.
+	Text bool
+}
+
+var codecs struct {
+	sync.RWMutex
+	byType     map[string]Codec
+	mediaTypes []string // in registration order
+}
+
+func init() {
+	RegisterCodec(GobMediaType, Codec{
+		NewClientCodec: newGobClientCodec,
+		NewServerCodec: newGobServerCodec,
+	})
+}
+
+// RegisterCodec makes a codec available under the given media type.  It
+// is typically called in the init function of the package implementing
+// the codec.  RegisterCodec panics if the media type is already registered
+// or if a constructor is missing.
+func RegisterCodec(mediaType string, codec Codec) {
+	if codec.NewClientCodec == nil || codec.NewServerCodec == nil {
+		panic("rpc: RegisterCodec " + mediaType + " without a constructor")
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if _, dup := codecs.byType[mediaType]; dup {
+		panic(fmt.Sprintf("rpc: RegisterCodec called twice for %s", mediaType))
+	}
+	if codecs.byType == nil {
+		codecs.byType = make(map[string]Codec)
+	}
+	codecs.byType[mediaType] = codec
+	codecs.mediaTypes = append(codecs.mediaTypes, mediaType)
+}
+
+// LookupCodec returns the codec registered under the given media type.
+func LookupCodec(mediaType string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.byType[mediaType]
+	return codec, ok
+}
+
+// MediaTypes returns the media types of the registered codecs, in the
+// order they were registered, starting with GobMediaType.
+func MediaTypes() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return append([]string(nil), codecs.mediaTypes...)
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser) ClientCodec {
+	encBuf := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(encBuf), encBuf}
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+}
@@ -0,0 +1,74 @@
+package comborpc
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// mediaRange is an element of an Accept header.
+type mediaRange struct {
+	mediaType string // possibly with wildcards: */* or type/*
+	q         float64
+}
+
+// parseAccept parses an Accept header, skipping invalid elements.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, elem := range strings.Split(header, ",") {
+		if strings.TrimSpace(elem) == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(elem)
+		if err != nil {
+			continue
+		}
+		r := mediaRange{mediaType: mediaType, q: 1}
+		if q, ok := params["q"]; ok {
+			if r.q, err = strconv.ParseFloat(q, 64); err != nil || r.q < 0 || r.q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// specificity returns how closely the range matches mediaType: 2 for the
+// type itself, 1 for type/*, 0 for */*, and -1 if it does not match.
+func (r mediaRange) specificity(mediaType string) int {
+	switch {
+	case r.mediaType == mediaType:
+		return 2
+	case r.mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(r.mediaType, "*")):
+		return 1
+	}
+	return -1
+}
+
+// negotiate returns the media type of available preferred by the Accept
+// header, or "" if none is acceptable.  The quality of a media type is
+// that of the most specific range matching it, and ties go to the first
+// available.  Without an Accept header, the first available is chosen.
+func negotiate(accept string, available []string) string {
+	if strings.TrimSpace(accept) == "" {
+		accept = "*/*"
+	}
+	ranges := parseAccept(accept)
+	var best string
+	var bestQ float64
+	for _, mediaType := range available {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := r.specificity(mediaType); s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
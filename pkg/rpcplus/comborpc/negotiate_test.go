@@ -0,0 +1,29 @@
+package comborpc
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	available := []string{"application/x-gob", "application/x-json", "text/plain"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/x-gob"},
+		{"*/*", "application/x-gob"},
+		{"application/x-json", "application/x-json"},
+		{"application/x-json; q=0.5, application/x-gob; q=0.4", "application/x-json"},
+		{"application/x-json; q=0.5, application/*", "application/x-gob"},
+		{"application/*; q=0.1, text/plain; q=0.2", "text/plain"},
+		{"*/*, application/x-gob; q=0", "application/x-json"},
+		{"text/*; q=0, */*; q=0.1", "application/x-gob"},
+		{"application/x-msgpack", ""},
+		{"application/x-gob; q=0", ""},
+		{"application/x-gob; q=2, application/x-json", "application/x-json"},
+		{"garbage/, application/x-json", "application/x-json"},
+	}
+	for _, test := range tests {
+		if got := negotiate(test.accept, available); got != test.want {
+			t.Errorf("negotiate(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
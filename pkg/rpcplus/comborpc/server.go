@@ -1,50 +1,68 @@
 package comborpc
 
 import (
-	"io"
 	"log"
-	"mime"
 	"net/http"
 
 	"github.com/shutej/flynn/pkg/rpcplus"
 	"github.com/shutej/flynn/pkg/rpcplus/jsonrpc"
+	"github.com/shutej/flynn/pkg/rpcplus/websocket"
+
+	// register the binary codecs, negotiated with the Accept header
+	_ "github.com/shutej/flynn/pkg/rpcplus/cborrpc"
+	_ "github.com/shutej/flynn/pkg/rpcplus/msgpackrpc"
 )
 
 type Server struct {
 	s *rpcplus.Server
+
+	// CheckOrigin reports whether to accept a WebSocket handshake from
+	// the Origin of req.  If nil, websocket.CheckSameOrigin only accepts
+	// those from the pages of the server.
+	CheckOrigin func(req *http.Request) bool
 }
 
 func New(s *rpcplus.Server) *Server {
-	return &Server{s}
+	return &Server{s: s}
 }
 
 func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if websocket.IsUpgrade(req) {
+		server.serveWebSocket(w, req)
+		return
+	}
+	if req.Method == "POST" {
+		// stateless JSON-RPC 2.0, one request (or batch) at a time
+		jsonrpc.NewHTTPHandler(server.s).ServeHTTP(w, req)
+		return
+	}
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("405 must CONNECT\n"))
+		w.Write([]byte("405 must CONNECT or POST\n"))
 		return
 	}
 
-	var serve func(conn io.ReadWriteCloser, loggers ...rpcplus.Logger)
-	accept, _, _ := mime.ParseMediaType(req.Header.Get("Accept"))
-	switch accept {
-	case "application/vnd.flynn.rpc-hijack+json":
-		serve = func(conn io.ReadWriteCloser, loggers ...rpcplus.Logger) {
-			codec := jsonrpc.NewServerCodec(conn)
-			server.s.ServeCodec(codec, loggers...)
-		}
-	default:
-		serve = server.s.ServeConn
+	mediaType := negotiate(req.Header.Get("Accept"), rpcplus.MediaTypes())
+	if mediaType == "" {
+		// older clients send an Accept header of their own, and
+		// expect gob
+		mediaType = rpcplus.GobMediaType
 	}
+	codec, _ := rpcplus.LookupCodec(mediaType)
 
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		log.Print("rpc hijacking error:", req.RemoteAddr, ": ", err.Error())
 		return
 	}
-	conn.Write([]byte("HTTP/1.0 200 Connected to Go RPC\n\n"))
-	serve(conn)
+	if rpcplus.AcceptsEncoding(req.Header.Get("Accept-Encoding"), rpcplus.FlateEncoding) {
+		conn.Write([]byte("HTTP/1.0 200 Connected to Go RPC\nContent-Type: " + mediaType + "\nContent-Encoding: " + rpcplus.FlateEncoding + "\n\n"))
+		server.s.ServeCodecWithContext(codec.NewServerCodec(rpcplus.NewFlateConn(conn)), rpcplus.ConnContext(req))
+		return
+	}
+	conn.Write([]byte("HTTP/1.0 200 Connected to Go RPC\nContent-Type: " + mediaType + "\n\n"))
+	server.s.ServeCodecWithContext(codec.NewServerCodec(conn), rpcplus.ConnContext(req))
 }
 
 func (server *Server) HandleHTTP(path string) {
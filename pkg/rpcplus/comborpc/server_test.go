@@ -0,0 +1,185 @@
+package comborpc
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shutej/flynn/pkg/rpcplus"
+	"github.com/shutej/flynn/pkg/rpcplus/jsonrpc"
+	"github.com/shutej/flynn/pkg/rpcplus/websocket"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	C int
+}
+
+type Arith int
+
+func (t *Arith) Add(args *Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Count(args *Args, stream rpcplus.Stream) error {
+	for i := 0; args.A == 0 || i < args.A; i++ {
+		select {
+		case stream.Send <- &Reply{C: i}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestWebSocket(t *testing.T) {
+	s := rpcplus.NewServer()
+	s.Register(new(Arith))
+	srv := httptest.NewServer(New(s))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	for _, mediaType := range []string{rpcplus.GobMediaType, jsonrpc.MediaType} {
+		client, err := DialWebSocket(url, mediaType, nil)
+		if err != nil {
+			t.Fatalf("%s: DialWebSocket: %s", mediaType, err)
+		}
+
+		reply := new(Reply)
+		if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+			t.Errorf("%s: Add: got %d, %v", mediaType, reply.C, err)
+		}
+
+		rows := make(chan *Reply)
+		c := client.StreamGo("Arith.Count", &Args{A: 5}, rows)
+		count := 0
+		for row := range rows {
+			if row.C != count {
+				t.Fatalf("%s: unexpected value %d", mediaType, row.C)
+			}
+			count++
+		}
+		if c.Error != nil || count != 5 {
+			t.Errorf("%s: Count: got %d values and error %v", mediaType, count, c.Error)
+		}
+
+		// an endless stream stops once closed by the client
+		rows = make(chan *Reply)
+		c = client.StreamGo("Arith.Count", &Args{}, rows)
+		<-rows
+		if err := c.CloseStream(); err != nil {
+			t.Fatalf("%s: CloseStream: %s", mediaType, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			for range rows {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: stream was not stopped", mediaType)
+		}
+		client.Close()
+	}
+
+	// no acceptable codec, before upgrading
+	header := http.Header{"Accept": {"application/x-unknown"}}
+	if _, err := websocket.Dial(url, nil, header); err == nil || !strings.Contains(err.Error(), "406") {
+		t.Errorf("expected 406 without an acceptable codec, got %v", err)
+	}
+}
+
+// testMediaType is a codec registered by the tests, unknown to comborpc.
+const testMediaType = "application/vnd.flynn.test+json"
+
+var testCodecConns int32
+
+func init() {
+	rpcplus.RegisterCodec(testMediaType, rpcplus.Codec{
+		NewClientCodec: jsonrpc.NewClientCodec,
+		NewServerCodec: func(conn io.ReadWriteCloser) rpcplus.ServerCodec {
+			atomic.AddInt32(&testCodecConns, 1)
+			return jsonrpc.NewServerCodec(conn)
+		},
+	})
+}
+
+func TestConnect(t *testing.T) {
+	atomic.StoreInt32(&testCodecConns, 0)
+	s := rpcplus.NewServer()
+	s.Register(new(Arith))
+	srv := httptest.NewServer(New(s))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	for _, accept := range []string{"", jsonrpc.MediaType, testMediaType + ", */*; q=0.1"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := make(http.Header)
+		if accept != "" {
+			header.Set("Accept", accept)
+		}
+		client, err := rpcplus.NewHTTPClient(conn, "/", header)
+		if err != nil {
+			t.Fatalf("%q: NewHTTPClient: %s", accept, err)
+		}
+		reply := new(Reply)
+		if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+			t.Errorf("%q: Add: got %d, %v", accept, reply.C, err)
+		}
+		client.Close()
+	}
+	if n := atomic.LoadInt32(&testCodecConns); n != 1 {
+		t.Errorf("expected a connection with the registered codec, got %d", n)
+	}
+
+	// compressed, with any codec
+	for _, accept := range []string{rpcplus.GobMediaType, jsonrpc.MediaType} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := http.Header{"Accept": {accept}, "Accept-Encoding": {rpcplus.FlateEncoding}}
+		client, err := rpcplus.NewHTTPClient(conn, "/", header)
+		if err != nil {
+			t.Fatalf("%q: NewHTTPClient: %s", accept, err)
+		}
+		reply := new(Reply)
+		if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+			t.Errorf("%q compressed: Add: got %d, %v", accept, reply.C, err)
+		}
+		client.Close()
+	}
+
+	// nothing acceptable: gob, as before negotiation
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Accept": {"application/x-unknown"}}
+	client, err := rpcplus.NewHTTPClient(conn, "/", header)
+	if err != nil {
+		t.Fatal("NewHTTPClient without an acceptable codec:", err)
+	}
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Errorf("Add without an acceptable codec: got %d, %v", reply.C, err)
+	}
+	client.Close()
+	if n := atomic.LoadInt32(&testCodecConns); n != 1 {
+		t.Errorf("expected gob without an acceptable codec, got %d connections with the registered codec", n)
+	}
+}
@@ -0,0 +1,70 @@
+package comborpc
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/shutej/flynn/pkg/rpcplus"
+	"github.com/shutej/flynn/pkg/rpcplus/websocket"
+)
+
+// Browsers cannot set the Accept header of a WebSocket handshake, so the
+// codec may also be chosen with a subprotocol: the subtype of its media
+// type, such as vnd.flynn.rpc-hijack+json.
+func subprotocol(mediaType string) string {
+	return strings.TrimPrefix(mediaType, "application/")
+}
+
+// serveWebSocket serves a connection upgraded to a WebSocket.  Codecs
+// writing text send text messages, one per response, others binary ones.
+// The codec is negotiated before the upgrade, so that a client is told
+// with a 406 response when none is acceptable.
+func (server *Server) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	var upgrader websocket.Upgrader
+	upgrader.CheckOrigin = server.CheckOrigin
+	mediaType := negotiate(req.Header.Get("Accept"), rpcplus.MediaTypes())
+	for _, p := range websocket.Subprotocols(req) {
+		if _, ok := rpcplus.LookupCodec("application/" + p); ok {
+			mediaType = "application/" + p
+			upgrader.Subprotocols = []string{p}
+			break
+		}
+	}
+	codec, ok := rpcplus.LookupCodec(mediaType)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotAcceptable)
+		w.Write([]byte("406 no acceptable codec\n"))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, req)
+	if err != nil {
+		log.Print("rpc websocket error:", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	if codec.Text {
+		conn.SetMessageType(websocket.TextMessage)
+	}
+	server.s.ServeCodecWithContext(codec.NewServerCodec(conn), rpcplus.ConnContext(req))
+}
+
+// DialWebSocket connects to the server at rawurl, a ws or wss URL, using
+// the codec registered under the given media type, such as
+// rpcplus.GobMediaType.  header is sent with the handshake and may be nil.
+func DialWebSocket(rawurl, mediaType string, header http.Header) (*rpcplus.Client, error) {
+	codec, ok := rpcplus.LookupCodec(mediaType)
+	if !ok {
+		return nil, errors.New("comborpc: no codec registered for " + mediaType)
+	}
+	conn, err := websocket.Dial(rawurl, []string{subprotocol(mediaType)}, header)
+	if err != nil {
+		return nil, err
+	}
+	if codec.Text {
+		conn.SetMessageType(websocket.TextMessage)
+	}
+	return rpcplus.NewClientWithCodec(codec.NewClientCodec(conn)), nil
+}
@@ -0,0 +1,88 @@
+package rpcplus
+
+import (
+	"compress/flate"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FlateEncoding is the content coding of connections compressed with
+// NewFlateConn: raw DEFLATE (RFC 1951) in each direction.  A client asks
+// for it in the Accept-Encoding header of its CONNECT request, and the
+// server agrees with the Content-Encoding header of its response.
+const FlateEncoding = "flate"
+
+type flateConn struct {
+	io.ReadWriteCloser
+	r io.Reader
+	w *flate.Writer
+}
+
+// NewFlateConn returns conn compressed with FlateEncoding.  Every write is
+// flushed, so that each message is delivered as soon as the codec sends
+// it, while the compression window is kept for the life of the connection:
+// repetitive payloads, such as the values of a stream, compress well.
+// Both ends of the connection must be compressed.
+func NewFlateConn(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	w, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &flateConn{ReadWriteCloser: conn, r: flate.NewReader(conn), w: w}
+}
+
+func (c *flateConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *flateConn) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// AcceptsEncoding reports whether an Accept-Encoding header accepts the
+// content coding.
+func AcceptsEncoding(header, coding string) bool {
+	for _, elem := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(elem, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// A DialOption configures Dial, DialHTTP and DialHTTPPath.
+type DialOption func(*dialOptions)
+
+type dialOptions struct {
+	compress bool
+}
+
+// WithCompression compresses the connection with FlateEncoding.  Over
+// HTTP, compression is only asked for, and the server may decline it.
+// Dial compresses the connection unconditionally, so the server must serve
+// it with NewFlateConn.
+func WithCompression() DialOption {
+	return func(o *dialOptions) {
+		o.compress = true
+	}
+}
+
+func newDialOptions(opts []DialOption) dialOptions {
+	var o dialOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,117 @@
+package rpcplus
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type Logs int
+
+// logLine is repeated by Tail, as log payloads are.
+var logLine = strings.Repeat("GET /index.html 200 ", 50)
+
+func (t *Logs) Tail(n int, stream Stream) error {
+	for i := 0; i < n; i++ {
+		select {
+		case stream.Send <- &logLine:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+// countingConn counts the bytes read from the connection.
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// tail reads a stream of 100 log lines and returns the bytes received.
+func tail(t *testing.T, client *Client, conn *countingConn) int64 {
+	before := atomic.LoadInt64(&conn.n)
+	lines := make(chan *string)
+	c := client.StreamGo("Logs.Tail", 100, lines)
+	count := 0
+	for line := range lines {
+		if *line != logLine {
+			t.Fatalf("unexpected line %q", *line)
+		}
+		count++
+	}
+	if c.Error != nil || count != 100 {
+		t.Fatalf("Tail: got %d lines and error %v", count, c.Error)
+	}
+	return atomic.LoadInt64(&conn.n) - before
+}
+
+func TestCompression(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Logs))
+
+	cli, srv := net.Pipe()
+	go server.ServeConn(NewFlateConn(srv))
+	conn := &countingConn{Conn: cli}
+	client := NewClient(NewFlateConn(conn))
+	defer client.Close()
+	size := int64(100 * len(logLine))
+	if n := tail(t, client, conn); n > size/10 {
+		t.Errorf("received %d bytes for %d bytes of lines", n, size)
+	}
+
+	// negotiated over HTTP
+	srvHTTP := httptest.NewServer(server)
+	defer srvHTTP.Close()
+	for _, compress := range []bool{false, true} {
+		var opts []DialOption
+		if compress {
+			opts = append(opts, WithCompression())
+		}
+		var conn *countingConn
+		dial := func(network, address string) (net.Conn, error) {
+			c, err := net.Dial(network, address)
+			conn = &countingConn{Conn: c}
+			return conn, err
+		}
+		client, err := DialHTTPPath("tcp", srvHTTP.Listener.Addr().String(), "/", dial, opts...)
+		if err != nil {
+			t.Fatal("dialing:", err)
+		}
+		n := tail(t, client, conn)
+		if compress && n > size/10 {
+			t.Errorf("received %d bytes for %d bytes of lines", n, size)
+		}
+		if !compress && n < size {
+			t.Errorf("received %d bytes for %d bytes of lines without compression", n, size)
+		}
+		client.Close()
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"flate", true},
+		{"gzip, FLATE;q=0.5", true},
+		{"gzip, flate; q=0", false},
+		{"deflate", false},
+		{"*", false},
+	}
+	for _, test := range tests {
+		if got := AcceptsEncoding(test.header, FlateEncoding); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.header, got, test.want)
+		}
+	}
+}
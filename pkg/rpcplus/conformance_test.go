@@ -0,0 +1,16 @@
+package rpcplus_test
+
+import (
+	"testing"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+	"github.com/shutej/flynn/pkg/rpcplus/rpctest"
+)
+
+func TestGobConformance(t *testing.T) {
+	codec, ok := rpc.LookupCodec(rpc.GobMediaType)
+	if !ok {
+		t.Fatal("gob codec not registered")
+	}
+	rpctest.TestCodec(t, codec)
+}
@@ -0,0 +1,73 @@
+package rpcplus
+
+import (
+	"errors"
+)
+
+// An ErrorCode classifies an Error.  Codes below 100 are reserved for the
+// rpcplus packages; services are free to use any other value.
+type ErrorCode int
+
+const (
+	CodeUnknown           ErrorCode = 0 // no code was given
+	CodeInvalidRequest    ErrorCode = 1 // the request header is ill-formed
+	CodeUnknownService    ErrorCode = 2 // no such service is registered
+	CodeUnknownMethod     ErrorCode = 3 // the service has no such method
+	CodeBadArgument       ErrorCode = 4 // the argument could not be decoded
+	CodeInternal          ErrorCode = 5 // the method panicked
+	CodeUnavailable       ErrorCode = 6 // the server is shutting down
+	CodeResourceExhausted ErrorCode = 7 // the call exceeded a limit of the server
+)
+
+// Error is a structured error that survives the trip from a service method
+// to the client.  Methods may return an *Error (or an error wrapping one),
+// and clients can retrieve it with errors.As.  errors.Is reports whether two
+// Errors have the same non-zero Code, so the Err variables below can be
+// used to test for the errors generated by the server itself.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]string // optional
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code != CodeUnknown && t.Code == e.Code
+}
+
+// NewError returns an *Error with the given code and message.
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+var (
+	ErrInvalidRequest    = NewError(CodeInvalidRequest, "rpc: invalid request")
+	ErrUnknownService    = NewError(CodeUnknownService, "rpc: can't find service")
+	ErrUnknownMethod     = NewError(CodeUnknownMethod, "rpc: can't find method")
+	ErrBadArgument       = NewError(CodeBadArgument, "rpc: bad argument")
+	ErrInternal          = NewError(CodeInternal, "rpc: internal error")
+	ErrResourceExhausted = NewError(CodeResourceExhausted, "rpc: resource exhausted")
+)
+
+// setError fills the error fields of the response header from err.
+func (r *Response) setError(err error) {
+	r.Error = err.Error()
+	var e *Error
+	if errors.As(err, &e) {
+		r.ErrorCode = e.Code
+		r.ErrorDetails = e.Details
+	}
+}
+
+// serverError returns the error carried by the response header: an *Error
+// if it has a code or details, a ServerError otherwise.
+func (r *Response) serverError() error {
+	if r.ErrorCode == CodeUnknown && r.ErrorDetails == nil {
+		return ServerError(r.Error)
+	}
+	return &Error{Code: r.ErrorCode, Message: r.Error, Details: r.ErrorDetails}
+}
@@ -0,0 +1,369 @@
+package fdrpc
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/shutej/flynn/pkg/rpcplus"
+)
+
+type Pipes int
+
+// Write writes "hello" to the descriptors it receives and closes them.
+func (p *Pipes) Write(fds []FD, n *int) error {
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd.FD), "pipe")
+		if _, err := f.Write([]byte("hello")); err != nil {
+			f.Close()
+			return err
+		}
+		f.Close()
+		*n++
+	}
+	return nil
+}
+
+type Process struct {
+	Name           string
+	Stdout, Stderr FD
+	Extra          map[string][]FD
+	Log            *ClosingFD
+}
+
+// Open returns the read ends of new pipes, holding "hello".
+func (p *Pipes) Open(name string, proc *Process) error {
+	*proc = Process{
+		Name:   name,
+		Stdout: FD{pipe("hello")},
+		Stderr: FD{pipe("hello")},
+		Extra:  map[string][]FD{"fd3": {{pipe("hello")}}},
+		Log:    &ClosingFD{pipe("hello")},
+	}
+	return nil
+}
+
+// pipe returns the read end of a new pipe holding msg.
+func pipe(msg string) int {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		panic(err)
+	}
+	syscall.Write(fds[1], []byte(msg))
+	syscall.Close(fds[1])
+	return fds[0]
+}
+
+// Stream sends n pipes, each holding its number.
+func (p *Pipes) Stream(n int, stream rpcplus.Stream) error {
+	for i := 0; i < n; i++ {
+		select {
+		case stream.Send <- ClosingFD{pipe(strconv.Itoa(i))}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Echo writes back on each pipe it receives the number of pipes received
+// before it.
+func (p *Pipes) Echo(in <-chan *FD, stream rpcplus.Stream) error {
+	i := 0
+	for fd := range in {
+		syscall.Write(fd.FD, []byte(strconv.Itoa(i)))
+		syscall.Close(fd.FD)
+		i++
+	}
+	return nil
+}
+
+const CodeTooMany rpcplus.ErrorCode = 1000
+
+// Checked fails with a coded error, closing the descriptors it receives.
+func (p *Pipes) Checked(fds []FD, n *int) error {
+	for _, fd := range fds {
+		syscall.Close(fd.FD)
+	}
+	err := &rpcplus.Error{Code: CodeTooMany, Message: "too many", Details: map[string]string{"max": "0"}}
+	return fmt.Errorf("Checked: %w", err)
+}
+
+// Metadata replies with the token sent by the client along with a pipe,
+// and sends back its trace.
+func (p *Pipes) Metadata(ctx context.Context, token string, proc *Process) error {
+	md := rpcplus.MetadataFromContext(ctx)
+	proc.Name = md["token"]
+	proc.Stdout = FD{pipe(token)}
+	rpcplus.SetResponseMetadata(ctx, "trace", md["trace"]+"-done")
+	return nil
+}
+
+func init() {
+	rpcplus.Register(new(Pipes))
+}
+
+// unixPair returns both ends of a connected pair of Unix sockets.
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socket")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestSendFD(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	// more descriptors than fit in a single message
+	for _, count := range []int{2, 300} {
+		var readers, writers []*os.File
+		var fds []FD
+		for i := 0; i < count; i++ {
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			readers = append(readers, r)
+			writers = append(writers, w)
+			fds = append(fds, FD{int(w.Fd())})
+		}
+
+		var n int
+		if err := client.Call("Pipes.Write", fds, &n); err != nil {
+			t.Fatal("Write:", err)
+		}
+		if n != count {
+			t.Fatalf("Write: expected %d descriptors, got %d", count, n)
+		}
+		for i, r := range readers {
+			if fds[i].FD != int(writers[i].Fd()) {
+				t.Errorf("argument %d was modified: %v", i, fds[i])
+			}
+			// the server closed its copy, close ours to read to the end
+			writers[i].Close()
+			b, err := io.ReadAll(r)
+			if err != nil || string(b) != "hello" {
+				t.Errorf("expected hello, got %q, %v", b, err)
+			}
+		}
+	}
+}
+
+func TestNestedFDs(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	var proc Process
+	if err := client.Call("Pipes.Open", "worker", &proc); err != nil {
+		t.Fatal("Open:", err)
+	}
+	if proc.Name != "worker" || len(proc.Extra["fd3"]) != 1 || proc.Log == nil {
+		t.Fatalf("unexpected reply %+v", proc)
+	}
+	for _, fd := range []int{proc.Stdout.FD, proc.Stderr.FD, proc.Extra["fd3"][0].FD, proc.Log.FD} {
+		f := os.NewFile(uintptr(fd), "pipe")
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(b) != "hello" {
+			t.Errorf("expected hello, got %q, %v", b, err)
+		}
+	}
+}
+
+// readFD reads fd to the end and closes it.
+func readFD(t *testing.T, fd int) string {
+	f := os.NewFile(uintptr(fd), "pipe")
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Error(err)
+	}
+	return string(b)
+}
+
+func TestStreamFDs(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	fds := make(chan *FD)
+	call := client.StreamGo("Pipes.Stream", 10, fds)
+	i := 0
+	for fd := range fds {
+		if got := readFD(t, fd.FD); got != strconv.Itoa(i) {
+			t.Errorf("pipe %d: got %q", i, got)
+		}
+		i++
+	}
+	if call.Error != nil || i != 10 {
+		t.Fatalf("Stream: got %d pipes and error %v", i, call.Error)
+	}
+
+	// descriptors sent by the client
+	replies := make(chan *struct{})
+	call = client.BidiStreamGo("Pipes.Echo", replies)
+	for i := 0; i < 10; i++ {
+		var p [2]int
+		if err := syscall.Pipe(p[:]); err != nil {
+			t.Fatal(err)
+		}
+		if err := call.Send(ClosingFD{p[1]}); err != nil {
+			t.Fatal("Send:", err)
+		}
+		if got := readFD(t, p[0]); got != strconv.Itoa(i) {
+			t.Errorf("pipe %d: got %q", i, got)
+		}
+	}
+	if err := call.CloseSend(); err != nil {
+		t.Fatal("CloseSend:", err)
+	}
+	for range replies {
+	}
+	if call.Error != nil {
+		t.Fatal("Echo:", call.Error)
+	}
+}
+
+func TestReclaimFDs(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	// a reply that does not hold the descriptors sent with it
+	var name struct{ Name string }
+	if err := client.Call("Pipes.Open", "worker", &name); err != nil {
+		t.Fatal("Open:", err)
+	}
+	if name.Name != "worker" {
+		t.Errorf("unexpected reply %+v", name)
+	}
+	if n := OutstandingFDs(); n != 0 {
+		t.Errorf("%d descriptors outstanding after a reply", n)
+	}
+
+	// a request that is not served
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	if err := client.Call("Pipes.Unknown", ClosingFD{p[1]}, &name); err == nil {
+		t.Error("expected an error calling an unknown method")
+	}
+	if n := OutstandingFDs(); n != 0 {
+		t.Errorf("%d descriptors outstanding after a rejected request", n)
+	}
+	// the server closed the write end, reading ends
+	if n, err := syscall.Read(p[0], make([]byte, 1)); n != 0 || err != nil {
+		t.Errorf("expected the pipe to be closed, read %d bytes, %v", n, err)
+	}
+
+	// descriptors received when the connection is closed
+	a, b := unixPair(t)
+	w, r := NewFDWriter(a), NewFDReader(b)
+	defer w.Close()
+	w.AddFD(p[0])
+	w.AddFD(p[0])
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := OutstandingFDs(); n != 2 {
+		t.Errorf("expected 2 descriptors outstanding, got %d", n)
+	}
+	r.Close()
+	if n := OutstandingFDs(); n != 0 {
+		t.Errorf("%d descriptors outstanding after closing", n)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	cli, srv := unixPair(t)
+	defer srv.Close()
+	client := NewClient(cli)
+	defer client.Close()
+
+	// a server of an earlier version replies with unframed gob
+	go func() {
+		srv.Read(make([]byte, 1))
+		gob.NewEncoder(srv).Encode(&rpcplus.Response{ServiceMethod: "Pipes.Write"})
+	}()
+	var n int
+	if err := client.Call("Pipes.Write", []FD{}, &n); err != ErrVersionMismatch {
+		t.Errorf("expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestError(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[0])
+	var n int
+	err := client.Call("Pipes.Checked", []FD{{p[1]}}, &n)
+	syscall.Close(p[1])
+	var rpcErr *rpcplus.Error
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("Checked: expected *rpcplus.Error, got %#v", err)
+	}
+	if rpcErr.Code != CodeTooMany || rpcErr.Message != "Checked: too many" || rpcErr.Details["max"] != "0" {
+		t.Errorf("Checked: unexpected error %#v", rpcErr)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	cli, srv := unixPair(t)
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	ctx := rpcplus.WithMetadata(context.Background(), map[string]string{"token": "secret", "trace": "abc"})
+	var proc Process
+	call := <-client.GoContext(ctx, "Pipes.Metadata", "hello", &proc, nil).Done
+	if call.Error != nil {
+		t.Fatal("Metadata:", call.Error)
+	}
+	if proc.Name != "secret" {
+		t.Errorf("Metadata: expected token %q, got %q", "secret", proc.Name)
+	}
+	if trace := call.ResponseMetadata["trace"]; trace != "abc-done" {
+		t.Errorf("Metadata: expected trace %q, got %q", "abc-done", trace)
+	}
+	if got := readFD(t, proc.Stdout.FD); got != "hello" {
+		t.Errorf("Metadata: expected hello on the pipe, got %q", got)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bufio"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/shutej/flynn/pkg/rpcplus"
@@ -14,76 +17,184 @@ type FD struct {
 	FD int
 }
 
+// outstandingFDs counts the descriptors received by all FDReaders and not
+// yet claimed with GetFD.
+var outstandingFDs int64
+
+// OutstandingFDs returns the number of descriptors received and not yet
+// claimed, which are held open by their FDReaders.  The codecs close those
+// that a message does not claim once it is decoded, so it should not grow.
+func OutstandingFDs() int64 {
+	return atomic.LoadInt64(&outstandingFDs)
+}
+
 type FDReader struct {
-	conn    *net.UnixConn
+	conn *net.UnixConn
+
+	// mu guards FDs and closed: Close may be called while reading.
+	mu      sync.Mutex
 	FDs     map[int]int
 	fdCount int
+	closed  bool
+
+	// buf holds the data of the current frame read from conn and not yet
+	// returned, and remaining the length of the rest of the frame.
+	rbuf      []byte
+	buf       []byte
+	remaining int
+
+	prefaceRead, prefaceSent bool
 }
 
 func NewFDReader(conn *net.UnixConn) *FDReader {
-	return &FDReader{conn, make(map[int]int), 0}
+	return &FDReader{conn: conn, FDs: make(map[int]int)}
 }
 
+// Close closes the connection and the descriptors not yet claimed.
 func (r *FDReader) Close() error {
-	return r.conn.Close()
+	err := r.conn.Close()
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.Reclaim()
+	return err
 }
 
-func (r *FDReader) Read(b []byte) (int, error) {
-	oob := make([]byte, 32)
-	n, oobn, _, _, err := r.conn.ReadMsgUnix(b, oob)
-	if err != nil {
-		if n < 0 {
-			n = 0
-		}
-		return n, err
+// Reclaim closes the descriptors received and not yet claimed with GetFD.
+func (r *FDReader) Reclaim() {
+	r.mu.Lock()
+	fds := r.FDs
+	r.FDs = make(map[int]int)
+	r.mu.Unlock()
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+	atomic.AddInt64(&outstandingFDs, -int64(len(fds)))
+}
+
+// fill reads data of the current frame into buf, reading the header of the
+// next frame, and receiving its descriptors, if the current one is over.
+func (r *FDReader) fill() error {
+	if err := readPreface(r.conn, &r.prefaceRead); err != nil {
+		return err
 	}
-	if oobn > 0 {
-		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	for r.remaining == 0 {
+		length, fds, err := readFrameHeader(r.conn)
 		if err != nil {
-			return n, err
+			return err
+		}
+		if err := r.addFDs(fds); err != nil {
+			return err
 		}
-		for _, m := range messages {
-			fds, err := syscall.ParseUnixRights(&m)
-			if err != nil {
-				return n, err
-			}
-
-			// Set the CLOEXEC flag on the FDs so they won't be leaked into future forks
-			for _, fd := range fds {
-				if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, syscall.FD_CLOEXEC); errno != 0 {
-					return n, errno
-				}
-
-				r.FDs[r.fdCount] = fd
-				r.fdCount++
-			}
+		r.remaining = length
+	}
+
+	if r.rbuf == nil {
+		r.rbuf = make([]byte, 4096)
+	}
+	b := r.rbuf
+	if len(b) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.conn.Read(b)
+	r.remaining -= n
+	r.buf = b[:n]
+	if n > 0 {
+		return nil
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *FDReader) addFDs(fds []int) error {
+	// Set the CLOEXEC flag on the FDs so they won't be leaked into future forks
+	for _, fd := range fds {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, syscall.FD_CLOEXEC); errno != 0 {
+			closeFDs(fds)
+			return errno
 		}
 	}
 
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		closeFDs(fds)
+		return nil
+	}
+	for _, fd := range fds {
+		r.FDs[r.fdCount] = fd
+		r.fdCount++
+	}
+	atomic.AddInt64(&outstandingFDs, int64(len(fds)))
+	return nil
+}
+
+// Read reads the data of the frames sent by an FDWriter, never past the end
+// of a frame, so that the descriptors sent with the data read are received
+// by the time it is returned, and those sent with later data are not.
+func (r *FDReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
 	return n, nil
 }
 
+// ReadByte makes FDReader an io.ByteReader, so that a gob.Decoder reads
+// exactly the messages it decodes rather than buffering ahead.
+func (r *FDReader) ReadByte() (byte, error) {
+	if len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	c := r.buf[0]
+	r.buf = r.buf[1:]
+	return c, nil
+}
+
 func (r *FDReader) Write(b []byte) (int, error) {
-	return r.conn.Write(b)
+	if err := writePreface(r.conn, &r.prefaceSent); err != nil {
+		return 0, err
+	}
+	return writeFrame(r.conn, b, nil)
 }
 
 func (r *FDReader) GetFD(index int) (int, error) {
+	r.mu.Lock()
 	fd, ok := r.FDs[index]
 	if !ok {
+		r.mu.Unlock()
 		return -1, fmt.Errorf("No received FD with index %d\n", index)
 	}
 	delete(r.FDs, index)
+	r.mu.Unlock()
+	atomic.AddInt64(&outstandingFDs, -1)
 	return fd, nil
 }
 
 type gobClientCodec struct {
 	fdReader *FDReader
+	fdWriter *FDWriter
 	dec      *gob.Decoder
 	enc      *gob.Encoder
 	encBuf   *bufio.Writer
 }
 
 func (c *gobClientCodec) WriteRequest(r *rpcplus.Request, body interface{}) (err error) {
+	body, closing := attachFDs(c.fdWriter, body)
+	for _, fd := range closing {
+		defer syscall.Close(fd)
+	}
+
 	if err = c.enc.Encode(r); err != nil {
 		return
 	}
@@ -97,38 +208,28 @@ func (c *gobClientCodec) ReadResponseHeader(r *rpcplus.Response) error {
 	return c.dec.Decode(r)
 }
 
+// ReadResponseBody decodes body and closes the descriptors sent with the
+// response that it does not hold.
 func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	defer c.fdReader.Reclaim()
 	if err := c.dec.Decode(body); err != nil {
 		return err
 	}
-
-	var err error
-	switch f := body.(type) {
-	case *FD:
-		f.FD, err = c.fdReader.GetFD(f.FD)
-		if err != nil {
-			return err
-		}
-	case *[]FD:
-		for i, fd := range *f {
-			(*f)[i].FD, err = c.fdReader.GetFD(fd.FD)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
+	return resolveFDs(c.fdReader, body)
 }
 
 func (c *gobClientCodec) Close() error {
 	return c.fdReader.Close()
 }
 
+// NewClient returns a client on conn.  The FDs held by arguments, in their
+// fields, elements or map values, are sent to the server with SCM_RIGHTS,
+// as are those held by replies to the client.  ClosingFDs are closed once
+// sent.
 func NewClient(conn *net.UnixConn) *rpcplus.Client {
-	fdReader := NewFDReader(conn)
-	encBuf := bufio.NewWriter(fdReader)
-	client := &gobClientCodec{fdReader, gob.NewDecoder(fdReader), gob.NewEncoder(encBuf), encBuf}
+	rw := fdConn{NewFDReader(conn), NewFDWriter(conn)}
+	encBuf := bufio.NewWriter(rw)
+	client := &gobClientCodec{rw.r, rw.w, gob.NewDecoder(rw), gob.NewEncoder(encBuf), encBuf}
 	return rpcplus.NewClientWithCodec(client)
 }
 
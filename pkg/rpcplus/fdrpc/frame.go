@@ -0,0 +1,153 @@
+package fdrpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Data is framed so that descriptors are received with the data sent with
+// them, however the receiver buffers its reads.  A frame is a header, the
+// length of the data and the number of descriptors as big-endian uint32s,
+// followed by the descriptors, in chunks each sent with a single byte, and
+// then by the data.
+//
+// The frames sent in each direction follow a preface naming the version of
+// the framing, so that a peer speaking another version, such as the
+// unframed gob of earlier versions of fdrpc, is rejected with
+// ErrVersionMismatch rather than misread: both ends of a connection must be
+// upgraded together.
+
+const frameHeaderLen = 8
+
+// framePreface is sent before the first frame.
+var framePreface = []byte("fdrpc/2\n")
+
+// ErrVersionMismatch is returned when the peer does not speak this version
+// of the fdrpc framing.
+var ErrVersionMismatch = errors.New("fdrpc: the peer speaks another version of fdrpc")
+
+// maxChunkFDs is the most descriptors sent in a single message (Linux's
+// SCM_MAX_FD).
+const maxChunkFDs = 253
+
+// ErrTruncatedFDs is returned when the descriptors sent with a message do
+// not all reach the receiver, for example because it has too many open
+// files.
+var ErrTruncatedFDs = errors.New("fdrpc: descriptors truncated")
+
+// writePreface sends the preface on conn, once: sent records whether it
+// has been.
+func writePreface(conn *net.UnixConn, sent *bool) error {
+	if *sent {
+		return nil
+	}
+	if _, err := conn.Write(framePreface); err != nil {
+		return err
+	}
+	*sent = true
+	return nil
+}
+
+// readPreface reads the preface from conn, once: read records whether it
+// has been.
+func readPreface(conn *net.UnixConn, read *bool) error {
+	if *read {
+		return nil
+	}
+	preface := make([]byte, len(framePreface))
+	if _, err := io.ReadFull(conn, preface); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return ErrVersionMismatch
+		}
+		return err
+	}
+	if !bytes.Equal(preface, framePreface) {
+		return ErrVersionMismatch
+	}
+	*read = true
+	return nil
+}
+
+// writeFrame sends b with fds on conn.
+func writeFrame(conn *net.UnixConn, b []byte, fds []int) (int, error) {
+	var header [frameHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(fds)))
+	if _, err := conn.Write(header[:]); err != nil {
+		return 0, err
+	}
+	for len(fds) > 0 {
+		n := len(fds)
+		if n > maxChunkFDs {
+			n = maxChunkFDs
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds[:n]...), nil); err != nil {
+			return 0, err
+		}
+		fds = fds[n:]
+	}
+	return conn.Write(b)
+}
+
+// readFrameHeader reads the header of the next frame on conn, and returns
+// the length of its data and its descriptors.
+func readFrameHeader(conn *net.UnixConn) (int, []int, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:4]))
+	count := int(binary.BigEndian.Uint32(header[4:]))
+	var fds []int
+	for len(fds) < count {
+		n := count - len(fds)
+		if n > maxChunkFDs {
+			n = maxChunkFDs
+		}
+		chunk, err := readFDs(conn, n)
+		fds = append(fds, chunk...)
+		if err != nil {
+			closeFDs(fds)
+			return 0, nil, err
+		}
+	}
+	return length, fds, nil
+}
+
+// readFDs reads a chunk of n descriptors from conn.
+func readFDs(conn *net.UnixConn, n int) ([]int, error) {
+	oob := make([]byte, syscall.CmsgSpace(n*4))
+	bn, oobn, flags, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+	if bn == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, m := range messages {
+		rights, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			return fds, err
+		}
+		fds = append(fds, rights...)
+	}
+	if flags&syscall.MSG_CTRUNC != 0 || len(fds) != n {
+		return fds, ErrTruncatedFDs
+	}
+	return fds, nil
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,207 @@
+package fdrpc
+
+import (
+	"reflect"
+	"sync"
+)
+
+var (
+	fdType        = reflect.TypeOf(FD{})
+	closingFDType = reflect.TypeOf(ClosingFD{})
+)
+
+// fdTypes caches whether values of a type may hold descriptors.
+var fdTypes sync.Map // map[reflect.Type]bool
+
+// mayHoldFD reports whether values of type t may hold an FD or a
+// ClosingFD, anywhere in their fields, elements or map values.  Values of
+// other types are sent as they are.
+func mayHoldFD(t reflect.Type) bool {
+	if ok, cached := fdTypes.Load(t); cached {
+		return ok.(bool)
+	}
+	ok := typeHoldsFD(t, make(map[reflect.Type]bool))
+	fdTypes.Store(t, ok)
+	return ok
+}
+
+func typeHoldsFD(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == fdType || t == closingFDType {
+		return true
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHoldsFD(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && typeHoldsFD(f.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attachFDs adds the descriptors held by body to w, and returns the body to
+// encode in its place, holding their indexes, and the descriptors of the
+// ClosingFDs to close once it is sent.  Descriptors are found in exported
+// struct fields, pointers, interfaces, slices, arrays and map values, but
+// not in map keys.  body itself is left untouched.
+func attachFDs(w *FDWriter, body interface{}) (interface{}, []int) {
+	if body == nil {
+		return nil, nil
+	}
+	a := &fdAttacher{w: w}
+	return a.copy(reflect.ValueOf(body)).Interface(), a.closing
+}
+
+type fdAttacher struct {
+	w       *FDWriter
+	closing []int
+}
+
+// copy returns a copy of v in which descriptors are replaced with their
+// indexes.  Values which cannot hold descriptors are shared with v.
+func (a *fdAttacher) copy(v reflect.Value) reflect.Value {
+	t := v.Type()
+	if !mayHoldFD(t) {
+		return v
+	}
+	switch t {
+	case fdType, closingFDType:
+		fd := int(v.Field(0).Int())
+		if t == closingFDType {
+			a.closing = append(a.closing, fd)
+		}
+		out := reflect.New(t).Elem()
+		out.Field(0).SetInt(int64(a.w.AddFD(fd)))
+		return out
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(t.Elem())
+		out.Elem().Set(a.copy(v.Elem()))
+		return out
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.New(t).Elem()
+		out.Set(a.copy(v.Elem()))
+		return out
+	case reflect.Struct:
+		out := reflect.New(t).Elem()
+		out.Set(v)
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				out.Field(i).Set(a.copy(v.Field(i)))
+			}
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(a.copy(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(t).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(a.copy(v.Index(i)))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(t, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			out.SetMapIndex(iter.Key(), a.copy(iter.Value()))
+		}
+		return out
+	}
+	return v
+}
+
+// resolveFDs replaces the indexes of the descriptors decoded into body,
+// wherever attachFDs finds them, with the descriptors received by r.
+func resolveFDs(r *FDReader, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return resolveValue(r, reflect.ValueOf(body))
+}
+
+// resolveValue resolves the descriptors held by v, which must be settable
+// unless it is a pointer, a slice or a map.
+func resolveValue(r *FDReader, v reflect.Value) error {
+	t := v.Type()
+	if !mayHoldFD(t) {
+		return nil
+	}
+	switch t {
+	case fdType, closingFDType:
+		fd, err := r.GetFD(int(v.Field(0).Int()))
+		if err != nil {
+			return err
+		}
+		v.Field(0).SetInt(int64(fd))
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return resolveValue(r, v.Elem())
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// the value of an interface is not settable, resolve a copy
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := resolveValue(r, elem); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" {
+				if err := resolveValue(r, v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(r, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		for iter := v.MapRange(); iter.Next(); {
+			elem := reflect.New(t.Elem()).Elem()
+			elem.Set(iter.Value())
+			if err := resolveValue(r, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+	return nil
+}
@@ -10,12 +10,20 @@ import (
 	"github.com/shutej/flynn/pkg/rpcplus"
 )
 
+// ClosingFD is an FD closed once it is sent.  A method streaming
+// descriptors sends ClosingFDs: values sent on a rpcplus.Stream are written
+// after Send returns, so the method cannot tell when to close an FD.
 type ClosingFD FD
 
 type FDWriter struct {
 	conn    *net.UnixConn
 	fds     []int
 	fdCount int
+
+	// r reads the frames sent by the peer, if any.
+	r *FDReader
+
+	prefaceSent bool
 }
 
 func NewFDWriter(conn *net.UnixConn) *FDWriter {
@@ -27,18 +35,20 @@ func (w *FDWriter) Close() error {
 }
 
 func (w *FDWriter) Read(b []byte) (int, error) {
-	return w.conn.Read(b)
+	if w.r == nil {
+		w.r = NewFDReader(w.conn)
+	}
+	return w.r.Read(b)
 }
 
+// Write sends b in a frame, with the FDs added since the last write.
 func (w *FDWriter) Write(b []byte) (int, error) {
-	if len(w.fds) == 0 {
-		return w.conn.Write(b)
-	} else {
-		rights := syscall.UnixRights(w.fds...)
-		n, _, err := w.conn.WriteMsgUnix(b, rights, nil)
-		w.fds = nil
-		return n, err
+	if err := writePreface(w.conn, &w.prefaceSent); err != nil {
+		return 0, err
 	}
+	fds := w.fds
+	w.fds = nil
+	return writeFrame(w.conn, b, fds)
 }
 
 func (w *FDWriter) AddFD(fd int) int {
@@ -48,7 +58,27 @@ func (w *FDWriter) AddFD(fd int) int {
 	return res
 }
 
+// fdConn receives descriptors with an FDReader and sends them with an
+// FDWriter, both on the same connection.
+type fdConn struct {
+	r *FDReader
+	w *FDWriter
+}
+
+func (c fdConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c fdConn) ReadByte() (byte, error) {
+	return c.r.ReadByte()
+}
+
+func (c fdConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
 type gobServerCodec struct {
+	fdReader *FDReader
 	fdWriter *FDWriter
 	dec      *gob.Decoder
 	enc      *gob.Encoder
@@ -59,21 +89,20 @@ func (c *gobServerCodec) ReadRequestHeader(r *rpcplus.Request) error {
 	return c.dec.Decode(r)
 }
 
+// ReadRequestBody decodes body and closes the descriptors sent with the
+// request that it does not hold.
 func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
-	return c.dec.Decode(body)
+	defer c.fdReader.Reclaim()
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	return resolveFDs(c.fdReader, body)
 }
 
 func (c *gobServerCodec) WriteResponse(r *rpcplus.Response, body interface{}, last bool) (err error) {
-	switch f := body.(type) {
-	case *FD:
-		f.FD = c.fdWriter.AddFD(f.FD)
-	case *[]FD:
-		for i, fd := range *f {
-			(*f)[i].FD = c.fdWriter.AddFD(fd.FD)
-		}
-	case *ClosingFD:
-		defer syscall.Close(f.FD)
-		body = &FD{c.fdWriter.AddFD(f.FD)}
+	body, closing := attachFDs(c.fdWriter, body)
+	for _, fd := range closing {
+		defer syscall.Close(fd)
 	}
 
 	if err = c.enc.Encode(r); err != nil {
@@ -86,7 +115,7 @@ func (c *gobServerCodec) WriteResponse(r *rpcplus.Response, body interface{}, la
 }
 
 func (c *gobServerCodec) Close() error {
-	return c.fdWriter.Close()
+	return c.fdReader.Close()
 }
 
 func ListenAndServe(path string) error {
@@ -106,9 +135,13 @@ func ListenAndServe(path string) error {
 	}
 }
 
+// ServeConn serves DefaultServer on conn.  The FDs held by replies, and by
+// the values sent on streams, are sent to the client with SCM_RIGHTS, and
+// those held by arguments, including the values of argument streams, are
+// received from it.
 func ServeConn(conn *net.UnixConn) {
-	fdWriter := NewFDWriter(conn)
-	buf := bufio.NewWriter(fdWriter)
-	srv := &gobServerCodec{fdWriter, gob.NewDecoder(fdWriter), gob.NewEncoder(buf), buf}
+	rw := fdConn{NewFDReader(conn), NewFDWriter(conn)}
+	buf := bufio.NewWriter(rw)
+	srv := &gobServerCodec{rw.r, rw.w, gob.NewDecoder(rw), gob.NewEncoder(buf), buf}
 	rpcplus.ServeCodec(srv)
 }
@@ -0,0 +1,189 @@
+package rpcplus
+
+import (
+	"reflect"
+	"sync"
+)
+
+// DefaultStreamWindow is a window suited to most streams: see
+// Client.SetStreamWindow.
+const DefaultStreamWindow = 64
+
+// MaxQueuedArgs is the number of values a client may send ahead of a method
+// receiving a stream.  Nothing slows the client down, so a call whose method
+// falls further behind fails with CodeResourceExhausted.
+const MaxQueuedArgs = 1024
+
+// valueQueue delivers values to a channel owned by user code without
+// blocking the goroutine that reads them from the connection.  A goroutine
+// delivers the values while some are queued; limit bounds how many.
+type valueQueue struct {
+	ch        reflect.Value // the channel the values are delivered to
+	limit     int           // the most values queued, 0 for no limit
+	delivered func()        // if not nil, called after each value is taken from ch
+	quit      chan struct{} // closed by stop
+
+	mu       sync.Mutex // protects the fields below
+	room     *sync.Cond // signalled when values leave the queue
+	values   []reflect.Value
+	pumping  bool // a goroutine is delivering the values
+	closed   bool // no more values are queued
+	stopped  bool // the queued values are dropped
+	overflow bool // a value was pushed beyond the limit
+	chClosed bool
+}
+
+func newValueQueue(ch reflect.Value, limit int, delivered func()) *valueQueue {
+	q := &valueQueue{ch: ch, limit: limit, delivered: delivered, quit: make(chan struct{})}
+	q.room = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues v for delivery, unless the queue is closed.  It reports false
+// if the queue is full: the queue is then stopped.
+func (q *valueQueue) push(v reflect.Value) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return true
+	}
+	if q.limit > 0 && len(q.values) >= q.limit {
+		q.overflow = true
+		q.stopLocked()
+		return false
+	}
+	q.add(v)
+	return true
+}
+
+// pushWait is like push but waits for room in a full queue.
+func (q *valueQueue) pushWait(v reflect.Value) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && q.limit > 0 && len(q.values) >= q.limit {
+		q.room.Wait()
+	}
+	if !q.closed {
+		q.add(v)
+	}
+}
+
+func (q *valueQueue) add(v reflect.Value) {
+	q.values = append(q.values, v)
+	if !q.pumping {
+		q.pumping = true
+		go q.pump()
+	}
+}
+
+// overflowed reports whether push found the queue full.
+func (q *valueQueue) overflowed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overflow
+}
+
+// close closes the channel once the queued values have been delivered.
+func (q *valueQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.room.Broadcast()
+	q.closeChan()
+}
+
+// stop drops the values not delivered yet and closes the channel.
+func (q *valueQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopLocked()
+}
+
+func (q *valueQueue) stopLocked() {
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	q.closed = true
+	q.values = nil
+	close(q.quit)
+	q.room.Broadcast()
+	q.closeChan()
+}
+
+// closeChan closes the channel of a closed queue once nothing is left to
+// deliver.  The pump closes it otherwise, as the only sender.
+func (q *valueQueue) closeChan() {
+	if q.closed && !q.pumping && !q.chClosed {
+		q.chClosed = true
+		q.ch.Close()
+	}
+}
+
+// pump delivers the values until the queue is empty or stopped.
+func (q *valueQueue) pump() {
+	quitCase := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.quit)}
+	for {
+		q.mu.Lock()
+		if len(q.values) == 0 {
+			q.pumping = false
+			q.closeChan()
+			q.mu.Unlock()
+			return
+		}
+		v := q.values[0]
+		q.values[0] = reflect.Value{}
+		q.values = q.values[1:]
+		q.room.Broadcast()
+		q.mu.Unlock()
+
+		sendCase := reflect.SelectCase{Dir: reflect.SelectSend, Chan: q.ch, Send: v}
+		if chosen, _, _ := reflect.Select([]reflect.SelectCase{sendCase, quitCase}); chosen == 1 {
+			// stopped: the queue is empty now
+			continue
+		}
+		if q.delivered != nil {
+			q.delivered()
+		}
+	}
+}
+
+// streamCredit counts the values a stream may send before the client
+// returns credit for them.
+type streamCredit struct {
+	ready chan struct{} // signalled when credit is added
+
+	mu sync.Mutex // protects n
+	n  uint32
+}
+
+func newStreamCredit(window uint32) *streamCredit {
+	return &streamCredit{ready: make(chan struct{}, 1), n: window}
+}
+
+// add returns n values of credit.
+func (c *streamCredit) add(n uint32) {
+	c.mu.Lock()
+	if c.n+n < c.n {
+		c.n = ^uint32(0)
+	} else {
+		c.n += n
+	}
+	c.mu.Unlock()
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take uses one value of credit, reporting false if there is none left:
+// ready is signalled once there is.
+func (c *streamCredit) take() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == 0 {
+		return false
+	}
+	c.n--
+	return true
+}
@@ -0,0 +1,68 @@
+package rpcplus
+
+import (
+	"context"
+)
+
+// ServerCall describes a method invocation as seen by interceptors.
+type ServerCall struct {
+	ServiceMethod string          // format: "Service.Method"
+	Context       context.Context // cancelled when the call is abandoned
+	ConnContext   interface{}     // the connection context
+	Args          interface{}     // the decoded argument, passed to the method; must keep its type
+	Reply         interface{}     // the reply sent to the client, nil for streams; must keep its type
+	Stream        bool            // true for a streaming method
+}
+
+// A Handler invokes the method described by a ServerCall.
+type Handler func(call *ServerCall) error
+
+// An Interceptor wraps every method invocation on a Server.  It may
+// inspect or replace call.Args before calling next, and inspect or replace
+// call.Reply and the returned error afterwards.  Returning without calling
+// next rejects the call with the returned error.
+//
+// A replacement for call.Args must have the type of the method argument,
+// as decoded, and one for call.Reply the type of the method reply: a nil or
+// differently typed value makes the call fail with a CodeInternal error
+// instead of reaching the method or the client.
+type Interceptor func(call *ServerCall, next Handler) error
+
+// A StreamInterceptor is called with each value a streaming method sends on
+// Stream.Send.  It returns the value to send in its place, or an error that
+// ends the stream; the method then receives the error on Stream.Error.
+type StreamInterceptor func(call *ServerCall, value interface{}) (interface{}, error)
+
+// Use adds an interceptor to the server.  Interceptors run in the order they
+// were added, the first one being the outermost.
+func (server *Server) Use(interceptor Interceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	n := len(server.interceptors)
+	server.interceptors = append(server.interceptors[:n:n], interceptor)
+}
+
+// UseStream adds a stream interceptor to the server.  Stream interceptors
+// run in the order they were added.
+func (server *Server) UseStream(interceptor StreamInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	n := len(server.streamInterceptors)
+	server.streamInterceptors = append(server.streamInterceptors[:n:n], interceptor)
+}
+
+func (server *Server) interceptorChain() ([]Interceptor, []StreamInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.interceptors, server.streamInterceptors
+}
+
+// intercept runs handler for call through interceptors.
+func intercept(interceptors []Interceptor, call *ServerCall, handler Handler) error {
+	if len(interceptors) == 0 {
+		return handler(call)
+	}
+	return interceptors[0](call, func(call *ServerCall) error {
+		return intercept(interceptors[1:], call, handler)
+	})
+}
@@ -0,0 +1,176 @@
+package rpcplus
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+
+	var mtx sync.Mutex
+	var order []string
+	server.Use(func(call *ServerCall, next Handler) error {
+		mtx.Lock()
+		order = append(order, "outer "+call.ServiceMethod)
+		mtx.Unlock()
+		if call.ServiceMethod == "Arith.Div" {
+			return errors.New("permission denied")
+		}
+		return next(call)
+	})
+	server.Use(func(call *ServerCall, next Handler) error {
+		mtx.Lock()
+		order = append(order, "inner "+call.ServiceMethod)
+		mtx.Unlock()
+		if args, ok := call.Args.(*Args); ok {
+			// validation may rewrite the arguments
+			call.Args = &Args{args.A, args.B + 1}
+		}
+		err := next(call)
+		if reply, ok := call.Reply.(*Reply); ok && err == nil {
+			reply.C *= 10
+		}
+		return err
+	})
+
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	reply := new(Reply)
+	if err := client.Call("Arith.Mul", &Args{7, 8}, reply); err != nil {
+		t.Fatal("Mul:", err)
+	}
+	if reply.C != 7*9*10 {
+		t.Errorf("Mul: expected %d got %d", 7*9*10, reply.C)
+	}
+
+	err := client.Call("Arith.Div", Args{7, 8}, reply)
+	if err == nil || err.Error() != "permission denied" {
+		t.Errorf("Div: expected permission denied; got %v", err)
+	}
+
+	// panics in the method are recovered below the interceptors
+	err = client.Call("Arith.Error", &Args{7, 8}, reply)
+	if err == nil || !strings.HasPrefix(err.Error(), "rpc: panic serving") {
+		t.Errorf("Error: expected panic error; got %v", err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	expected := []string{"outer Arith.Mul", "inner Arith.Mul", "outer Arith.Div", "outer Arith.Error", "inner Arith.Error"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected interceptors to run as %v, got %v", expected, order)
+	}
+}
+
+func TestStreamInterceptors(t *testing.T) {
+	server := NewServer()
+	server.Register(new(StreamingArith))
+
+	var streams int
+	server.Use(func(call *ServerCall, next Handler) error {
+		if call.Stream {
+			streams++
+		}
+		return next(call)
+	})
+	server.UseStream(func(call *ServerCall, value interface{}) (interface{}, error) {
+		reply := value.(*StreamingReply)
+		if reply.Index == 3 {
+			return nil, errors.New("stopped by interceptor")
+		}
+		return &StreamingReply{C: reply.C * 2, Index: reply.Index}, nil
+	})
+
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	rowChan := make(chan *StreamingReply, 10)
+	c := client.StreamGo("StreamingArith.Thrive", &StreamingArgs{3, 10, -1}, rowChan)
+	count := 0
+	for row := range rowChan {
+		if row.C != 6 {
+			t.Error("expected transformed value, got", row.C)
+		}
+		count++
+	}
+	if count != 3 {
+		t.Error("expected 3 values, got", count)
+	}
+	if c.Error == nil || c.Error.Error() != "stopped by interceptor" {
+		t.Error("expected interceptor error, got", c.Error)
+	}
+	if streams != 1 {
+		t.Error("expected one intercepted stream, got", streams)
+	}
+}
+
+func TestInterceptorArgsType(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Use(func(call *ServerCall, next Handler) error {
+		switch call.ServiceMethod {
+		case "Arith.Add":
+			call.Args = &Args{1, 2} // the method takes Args, not *Args
+		case "Arith.Mul":
+			call.Args = nil
+		}
+		return next(call)
+	})
+
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	for _, method := range []string{"Arith.Add", "Arith.Mul"} {
+		err := client.Call(method, &Args{7, 8}, new(Reply))
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInternal || !strings.Contains(err.Error(), "interceptor replaced the argument of "+method) {
+			t.Errorf("%s: expected an interceptor error, got %v", method, err)
+		}
+	}
+}
+
+func TestInterceptorReplyType(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	server.Use(func(call *ServerCall, next Handler) error {
+		err := next(call)
+		switch call.ServiceMethod {
+		case "Arith.Add":
+			call.Reply = Reply{C: 1} // the method replies with *Reply
+		case "Arith.Mul":
+			call.Reply = nil
+		}
+		return err
+	})
+
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	for _, method := range []string{"Arith.Add", "Arith.Mul"} {
+		err := client.Call(method, &Args{7, 8}, new(Reply))
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInternal || !strings.Contains(err.Error(), "interceptor replaced the reply of "+method) {
+			t.Errorf("%s: expected an interceptor error, got %v", method, err)
+		}
+	}
+
+	// the connection is still usable
+	reply := new(Reply)
+	if err := client.Call("Arith.Div", &Args{56, 8}, reply); err != nil || reply.C != 7 {
+		t.Errorf("Div: got %d, %v", reply.C, err)
+	}
+}
@@ -0,0 +1,197 @@
+package reflectcodec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// MaxBytes is the length of the longest string or byte string accepted.
+const MaxBytes = 64 << 20
+
+var errTooLong = errors.New("reflectcodec: string too long")
+
+// ReadBytes reads the n bytes of a string, for the Readers of the formats.
+func ReadBytes(r *bufio.Reader, n uint64) ([]byte, error) {
+	if n > MaxBytes {
+		return nil, errTooLong
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// requestHeader and responseHeader are the headers on the wire, maps with
+// the names of the fields of the RequestHeader and ResponseHeader messages
+// of protorpc's rpc.proto.
+type requestHeader struct {
+	ServiceMethod string            `codec:"service_method"`
+	Seq           uint64            `codec:"seq"`
+	Deadline      int64             `codec:"deadline,omitempty"` // nanoseconds since the Unix epoch
+	Window        uint32            `codec:"window,omitempty"`
+	Metadata      map[string]string `codec:"metadata,omitempty"`
+}
+
+type responseHeader struct {
+	ServiceMethod string            `codec:"service_method"`
+	Seq           uint64            `codec:"seq"`
+	Error         string            `codec:"error,omitempty"`
+	ErrorCode     rpc.ErrorCode     `codec:"error_code,omitempty"`
+	ErrorDetails  map[string]string `codec:"error_details,omitempty"`
+	Metadata      map[string]string `codec:"metadata,omitempty"`
+	More          bool              `codec:"more,omitempty"`
+	EOS           bool              `codec:"eos,omitempty"`
+}
+
+// Format is a wire format of tokens.  Every request and response is a
+// header value followed by a body value.
+type Format struct {
+	NewReader func(*bufio.Reader) Reader
+	NewWriter func(*bytes.Buffer) Writer
+}
+
+// conn holds what the server and client codecs share.
+type conn struct {
+	dec     Reader
+	hdr     bytes.Buffer
+	body    bytes.Buffer
+	hdrEnc  Writer
+	bodyEnc Writer
+	rwc     io.ReadWriteCloser
+}
+
+func (f Format) newConn(rwc io.ReadWriteCloser) *conn {
+	c := &conn{dec: f.NewReader(bufio.NewReader(rwc)), rwc: rwc}
+	c.hdrEnc = f.NewWriter(&c.hdr)
+	c.bodyEnc = f.NewWriter(&c.body)
+	return c
+}
+
+// encodeBody encodes x into c.body.
+func (c *conn) encodeBody(x interface{}) error {
+	c.body.Reset()
+	return Encode(c.bodyEnc, x)
+}
+
+// write sends a header, encoded after the body, followed by the body.
+func (c *conn) write(hdr interface{}) error {
+	c.hdr.Reset()
+	if err := Encode(c.hdrEnc, hdr); err != nil {
+		return err
+	}
+	c.hdr.Write(c.body.Bytes())
+	_, err := c.rwc.Write(c.hdr.Bytes())
+	return err
+}
+
+func (c *conn) Close() error {
+	return c.rwc.Close()
+}
+
+type serverCodec struct {
+	*conn
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using the format on conn.
+func (f Format) NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return serverCodec{f.newConn(conn)}
+}
+
+func (c serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	var h requestHeader
+	if err := Decode(c.dec, &h); err != nil {
+		return err
+	}
+	r.ServiceMethod = h.ServiceMethod
+	r.Seq = h.Seq
+	r.Deadline = time.Time{}
+	if h.Deadline != 0 {
+		r.Deadline = time.Unix(0, h.Deadline)
+	}
+	r.Window = h.Window
+	r.Metadata = h.Metadata
+	return nil
+}
+
+func (c serverCodec) ReadRequestBody(x interface{}) error {
+	return Decode(c.dec, x)
+}
+
+func (c serverCodec) WriteResponse(r *rpc.Response, x interface{}, last bool) error {
+	if err := c.encodeBody(x); err != nil {
+		// the client still expects the response
+		r.Error = err.Error()
+		r.ErrorCode = rpc.CodeInternal
+		c.body.Reset()
+		c.bodyEnc.WriteNil()
+	}
+	h := responseHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		Error:         r.Error,
+		ErrorCode:     r.ErrorCode,
+		ErrorDetails:  r.ErrorDetails,
+		Metadata:      r.Metadata,
+		More:          !last,
+	}
+	if h.Error == rpc.EndOfStream {
+		h.Error = ""
+		h.EOS = true
+	}
+	return c.write(&h)
+}
+
+type clientCodec struct {
+	*conn
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using the format on conn.
+func (f Format) NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return clientCodec{f.newConn(conn)}
+}
+
+func (c clientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	if err := c.encodeBody(x); err != nil {
+		return err
+	}
+	h := requestHeader{
+		ServiceMethod: r.ServiceMethod,
+		Seq:           r.Seq,
+		Window:        r.Window,
+		Metadata:      r.Metadata,
+	}
+	if !r.Deadline.IsZero() {
+		h.Deadline = r.Deadline.UnixNano()
+	}
+	return c.write(&h)
+}
+
+func (c clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	var h responseHeader
+	if err := Decode(c.dec, &h); err != nil {
+		return err
+	}
+	r.ServiceMethod = h.ServiceMethod
+	r.Seq = h.Seq
+	r.Error = h.Error
+	r.ErrorCode = h.ErrorCode
+	r.ErrorDetails = h.ErrorDetails
+	r.Metadata = h.Metadata
+	if h.EOS {
+		r.Error = rpc.EndOfStream
+	}
+	return nil
+}
+
+func (c clientCodec) ReadResponseBody(x interface{}) error {
+	return Decode(c.dec, x)
+}
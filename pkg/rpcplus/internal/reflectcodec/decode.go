@@ -0,0 +1,416 @@
+package reflectcodec
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var kindNames = [...]string{
+	Nil:    "nil",
+	Bool:   "bool",
+	Int:    "integer",
+	Uint:   "integer",
+	Float:  "float",
+	String: "string",
+	Bytes:  "bytes",
+	Array:  "array",
+	Map:    "map",
+	Break:  "break",
+}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", k)
+}
+
+// A TypeError describes a value that could not be decoded into a Go type.
+// The rest of the value is still decoded.
+type TypeError struct {
+	Kind Kind
+	Type reflect.Type
+}
+
+func (e *TypeError) Error() string {
+	return "reflectcodec: cannot decode " + e.Kind.String() + " into " + e.Type.String()
+}
+
+var errBreak = errors.New("reflectcodec: unexpected break")
+
+// Decode reads a value from r into v, which must be a non-nil pointer, or
+// nil to skip the value.
+func Decode(r Reader, v interface{}) error {
+	d := decoder{r: r}
+	t, err := r.Next()
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if v == nil {
+		return d.skip(t)
+	}
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		if err := d.skip(t); err != nil {
+			return err
+		}
+		return fmt.Errorf("reflectcodec: cannot decode into %T", v)
+	}
+	if err := d.value(t, rv.Elem()); err != nil {
+		return err
+	}
+	return d.err
+}
+
+type decoder struct {
+	r   Reader
+	err error // the first TypeError
+}
+
+// mismatch records that t cannot be decoded into v and skips it.
+func (d *decoder) mismatch(t Token, v reflect.Value) error {
+	if d.err == nil {
+		d.err = &TypeError{Kind: t.Kind, Type: v.Type()}
+	}
+	return d.skip(t)
+}
+
+// value decodes the value starting with t into v, which is addressable.
+func (d *decoder) value(t Token, v reflect.Value) error {
+	if t.Kind == Break {
+		return errBreak
+	}
+	if t.Kind == Nil {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(t, v.Elem())
+	}
+	if t.Kind == String && reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		if err := v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(t.Bytes); err != nil && d.err == nil {
+			d.err = err
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.mismatch(t, v)
+		}
+		x, err := d.generic(t)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		if t.Kind != Bool {
+			return d.mismatch(t, v)
+		}
+		v.SetBool(t.Bool)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := t.Int
+		if t.Kind == Uint {
+			i = int64(t.Uint)
+		}
+		if t.Kind != Int && (t.Kind != Uint || t.Uint > math.MaxInt64) || v.OverflowInt(i) {
+			return d.mismatch(t, v)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := t.Uint
+		if t.Kind == Int {
+			u = uint64(t.Int)
+		}
+		if t.Kind != Uint && (t.Kind != Int || t.Int < 0) || v.OverflowUint(u) {
+			return d.mismatch(t, v)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch t.Kind {
+		case Float:
+			v.SetFloat(t.Float)
+		case Int:
+			v.SetFloat(float64(t.Int))
+		case Uint:
+			v.SetFloat(float64(t.Uint))
+		default:
+			return d.mismatch(t, v)
+		}
+	case reflect.String:
+		if t.Kind != String && t.Kind != Bytes {
+			return d.mismatch(t, v)
+		}
+		v.SetString(string(t.Bytes))
+	case reflect.Slice:
+		if t.Kind == Bytes && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(t.Bytes)
+			return nil
+		}
+		if t.Kind != Array {
+			return d.mismatch(t, v)
+		}
+		return d.array(t, v)
+	case reflect.Array:
+		if t.Kind == Bytes && v.Type().Elem().Kind() == reflect.Uint8 {
+			reflect.Copy(v, reflect.ValueOf(t.Bytes))
+			return nil
+		}
+		if t.Kind != Array {
+			return d.mismatch(t, v)
+		}
+		return d.array(t, v)
+	case reflect.Map:
+		if t.Kind != Map {
+			return d.mismatch(t, v)
+		}
+		return d.mapValue(t, v)
+	case reflect.Struct:
+		if t.Kind != Map {
+			return d.mismatch(t, v)
+		}
+		return d.structValue(t, v)
+	default:
+		return d.mismatch(t, v)
+	}
+	return nil
+}
+
+// elements calls fn with the first token of each of the n elements of an
+// array or map, or of each element up to a Break if n is negative.
+func (d *decoder) elements(n int, fn func(Token) error) error {
+	for i := 0; n < 0 || i < n; i++ {
+		t, err := d.read()
+		if err != nil {
+			return err
+		}
+		if t.Kind == Break {
+			if n < 0 {
+				return nil
+			}
+			return errBreak
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads a token within a value, which the end of the input cuts
+// short.
+func (d *decoder) read() (Token, error) {
+	t, err := d.r.Next()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return t, err
+}
+
+// next reads the first token of the value of a map entry.
+func (d *decoder) next() (Token, error) {
+	t, err := d.read()
+	if err == nil && t.Kind == Break {
+		err = errBreak
+	}
+	return t, err
+}
+
+// maxPrealloc bounds the elements allocated ahead of decoding them, as
+// lengths are sent by the peer.
+const maxPrealloc = 1024
+
+func (d *decoder) array(t Token, v reflect.Value) error {
+	if v.Kind() == reflect.Slice {
+		n := t.Len
+		if n < 0 || n > maxPrealloc {
+			n = 0
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, n))
+	}
+	i := 0
+	err := d.elements(t.Len, func(e Token) error {
+		if v.Kind() == reflect.Slice {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+		} else if i >= v.Len() {
+			return d.skip(e)
+		}
+		i++
+		return d.value(e, v.Index(i-1))
+	})
+	if err != nil {
+		return err
+	}
+	for ; i < v.Len(); i++ {
+		v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+	}
+	return nil
+}
+
+func (d *decoder) mapValue(t Token, v reflect.Value) error {
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	kt, et := v.Type().Key(), v.Type().Elem()
+	return d.elements(t.Len, func(k Token) error {
+		key := reflect.New(kt).Elem()
+		if err := d.value(k, key); err != nil {
+			return err
+		}
+		e, err := d.next()
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(et).Elem()
+		if err := d.value(e, elem); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+	})
+}
+
+func (d *decoder) structValue(t Token, v reflect.Value) error {
+	fs := fields(v.Type())
+	return d.elements(t.Len, func(k Token) error {
+		if err := d.skip(k); err != nil {
+			return err
+		}
+		e, err := d.next()
+		if err != nil {
+			return err
+		}
+		if k.Kind != String && k.Kind != Bytes {
+			return d.skip(e)
+		}
+		if f, ok := lookup(fs, string(k.Bytes)); ok {
+			return d.value(e, v.Field(f.index))
+		}
+		return d.skip(e)
+	})
+}
+
+// lookup finds the field named name, preferring an exact match.
+func lookup(fs []field, name string) (field, bool) {
+	for _, f := range fs {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fs {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+// generic decodes the value starting with t as an interface{}: nil, bool,
+// int64, uint64 for integers too large for it, float64, string, []byte,
+// []interface{}, and map[string]interface{}, or map[interface{}]interface{}
+// if some keys are not strings.
+func (d *decoder) generic(t Token) (interface{}, error) {
+	switch t.Kind {
+	case Nil:
+		return nil, nil
+	case Bool:
+		return t.Bool, nil
+	case Int:
+		return t.Int, nil
+	case Uint:
+		if t.Uint <= math.MaxInt64 {
+			return int64(t.Uint), nil
+		}
+		return t.Uint, nil
+	case Float:
+		return t.Float, nil
+	case String:
+		return string(t.Bytes), nil
+	case Bytes:
+		return t.Bytes, nil
+	case Array:
+		a := []interface{}{}
+		err := d.elements(t.Len, func(e Token) error {
+			x, err := d.generic(e)
+			a = append(a, x)
+			return err
+		})
+		return a, err
+	case Map:
+		m := map[string]interface{}{}
+		var mi map[interface{}]interface{}
+		err := d.elements(t.Len, func(k Token) error {
+			key, err := d.generic(k)
+			if err != nil {
+				return err
+			}
+			e, err := d.next()
+			if err != nil {
+				return err
+			}
+			x, err := d.generic(e)
+			if err != nil {
+				return err
+			}
+			if s, ok := key.(string); ok && mi == nil {
+				m[s] = x
+				return nil
+			}
+			if key != nil && !reflect.TypeOf(key).Comparable() {
+				if d.err == nil {
+					d.err = &TypeError{Kind: k.Kind, Type: reflect.TypeOf(mi).Key()}
+				}
+				return nil
+			}
+			if mi == nil {
+				mi = make(map[interface{}]interface{}, len(m)+1)
+				for s, x := range m {
+					mi[s] = x
+				}
+			}
+			mi[key] = x
+			return nil
+		})
+		if mi != nil {
+			return mi, err
+		}
+		return m, err
+	}
+	return nil, errBreak
+}
+
+// skip reads the rest of the value starting with t.
+func (d *decoder) skip(t Token) error {
+	switch t.Kind {
+	case Break:
+		return errBreak
+	case Array:
+		return d.elements(t.Len, d.skip)
+	case Map:
+		return d.elements(t.Len, func(k Token) error {
+			if err := d.skip(k); err != nil {
+				return err
+			}
+			e, err := d.next()
+			if err != nil {
+				return err
+			}
+			return d.skip(e)
+		})
+	}
+	return nil
+}
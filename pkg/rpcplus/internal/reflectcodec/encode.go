@@ -0,0 +1,165 @@
+package reflectcodec
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// field is an exported field of a struct.
+type field struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+// fields returns the fields of struct type t to encode.
+func fields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		f := field{name: sf.Name, index: i}
+		if tag, ok := sf.Tag.Lookup("codec"); ok {
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name != "" {
+				f.name = name
+			}
+			f.omitEmpty = opts == "omitempty"
+		}
+		fs = append(fs, f)
+	}
+	fieldCache.Store(t, fs)
+	return fs
+}
+
+// Encode writes v to w.
+func Encode(w Writer, v interface{}) error {
+	return encode(w, reflect.ValueOf(v))
+}
+
+func encode(w Writer, v reflect.Value) error {
+	if !v.IsValid() {
+		w.WriteNil()
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		if v.Kind() == reflect.Interface || !v.Type().Implements(textMarshalerType) {
+			return encode(w, v.Elem())
+		}
+	}
+	if m, ok := textMarshaler(v); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return err
+		}
+		w.WriteString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		w.WriteBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i < 0 {
+			w.WriteInt(i)
+		} else {
+			w.WriteUint(uint64(i))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.WriteUint(v.Uint())
+	case reflect.Float32:
+		w.WriteFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.WriteFloat64(v.Float())
+	case reflect.String:
+		w.WriteString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.WriteBytes(v.Bytes())
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		w.WriteArrayHeader(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encode(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.WriteNil()
+			return nil
+		}
+		w.WriteMapHeader(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := encode(w, iter.Key()); err != nil {
+				return err
+			}
+			if err := encode(w, iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fs := fields(v.Type())
+		n := 0
+		for _, f := range fs {
+			if !f.omitEmpty || !v.Field(f.index).IsZero() {
+				n++
+			}
+		}
+		w.WriteMapHeader(n)
+		for _, f := range fs {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			w.WriteString(f.name)
+			if err := encode(w, fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("reflectcodec: cannot encode %s", v.Type())
+	}
+	return nil
+}
+
+// textMarshaler returns v as an encoding.TextMarshaler, if it is one.
+func textMarshaler(v reflect.Value) (encoding.TextMarshaler, bool) {
+	if v.Type().Implements(textMarshalerType) {
+		return v.Interface().(encoding.TextMarshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(textMarshalerType) {
+		return v.Addr().Interface().(encoding.TextMarshaler), true
+	}
+	return nil, false
+}
@@ -0,0 +1,55 @@
+// Package reflectcodec encodes Go values with reflection for the binary
+// codecs of rpcplus.  A wire format only reads and writes tokens: scalars,
+// and the headers of arrays and maps, followed by their elements.
+//
+// Structs are encoded as maps keyed by field name, which a `codec:"name"`
+// tag may change; `codec:"-"` skips a field and `codec:",omitempty"` omits
+// it when empty.  Values implementing encoding.TextMarshaler, such as
+// time.Time, are encoded as strings.
+package reflectcodec
+
+// Kind is the kind of a token.
+type Kind uint8
+
+const (
+	Nil    Kind = iota
+	Bool        // Token.Bool
+	Int         // Token.Int, for negative integers at least
+	Uint        // Token.Uint
+	Float       // Token.Float
+	String      // Token.Bytes, UTF-8
+	Bytes       // Token.Bytes
+	Array       // followed by Token.Len elements
+	Map         // followed by Token.Len keys, each followed by its value
+	Break       // ends an array or map of indefinite length
+)
+
+// Token is a scalar, or the header of an array or map.
+type Token struct {
+	Kind  Kind
+	Bool  bool
+	Int   int64
+	Uint  uint64
+	Float float64
+	Bytes []byte // owned by the token
+	Len   int    // negative for an indefinite length, ended by Break
+}
+
+// Reader reads the tokens of a wire format.
+type Reader interface {
+	Next() (Token, error)
+}
+
+// Writer writes the tokens of a wire format, usually to a bytes.Buffer.
+type Writer interface {
+	WriteNil()
+	WriteBool(v bool)
+	WriteInt(v int64) // negative
+	WriteUint(v uint64)
+	WriteFloat32(v float32)
+	WriteFloat64(v float64)
+	WriteString(v string)
+	WriteBytes(v []byte)
+	WriteArrayHeader(n int)
+	WriteMapHeader(n int)
+}
@@ -0,0 +1,238 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/shutej/flynn/pkg/rpcplus"
+)
+
+type response2 struct {
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  *Reply          `json:"result"`
+	Error   *struct {
+		Code    int               `json:"code"`
+		Message string            `json:"message"`
+		Data    map[string]string `json:"data"`
+	} `json:"error"`
+}
+
+func TestServer2(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn2(srv)
+	dec := json.NewDecoder(cli)
+
+	call := func(request string) response2 {
+		fmt.Fprintln(cli, request)
+		var resp response2
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		if resp.Version != "2.0" {
+			t.Fatalf("resp: bad version %q", resp.Version)
+		}
+		return resp
+	}
+
+	// named and positional params
+	resp := call(`{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 3, "B": 4}}`)
+	if resp.Error != nil || resp.Result == nil || resp.Result.C != 7 || string(resp.Id) != "1" {
+		t.Fatalf("named params: unexpected response %+v", resp)
+	}
+	resp = call(`{"jsonrpc": "2.0", "method": "Arith.Mul", "id": "two", "params": [{"A": 3, "B": 4}]}`)
+	if resp.Error != nil || resp.Result == nil || resp.Result.C != 12 || string(resp.Id) != `"two"` {
+		t.Fatalf("positional params: unexpected response %+v", resp)
+	}
+
+	// a notification gets no response: the next one is for the request after it
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 1}}`)
+	resp = call(`{"jsonrpc": "2.0", "method": "Arith.Add", "id": 3, "params": {"A": 1, "B": 2}}`)
+	if string(resp.Id) != "3" || resp.Result == nil || resp.Result.C != 3 {
+		t.Fatalf("after notification: unexpected response %+v", resp)
+	}
+
+	errorTests := []struct {
+		request string
+		code    int
+	}{
+		{`{"jsonrpc": "2.0", "method": "Arith.Unknown", "id": 4, "params": {}}`, CodeMethodNotFound},
+		{`{"jsonrpc": "2.0", "method": "Unknown.Add", "id": 4, "params": {}}`, CodeMethodNotFound},
+		{`{"jsonrpc": "2.0", "method": "foobar", "id": 4, "params": {}}`, CodeMethodNotFound},
+		{`{"jsonrpc": "2.0", "method": "Arith.Add.More", "id": 4, "params": {}}`, CodeMethodNotFound},
+		{`{"jsonrpc": "2.0", "method": "Arith.Add", "id": 4, "params": {"A": "x"}}`, CodeInvalidParams},
+		{`{"jsonrpc": "2.0", "method": "Arith.Add", "id": 4, "params": [1, 2]}`, CodeInvalidParams},
+		{`{"method": "Arith.Add", "id": 4, "params": {}}`, CodeInvalidRequest},
+		{`{"jsonrpc": "2.0", "method": 1, "id": 4}`, CodeInvalidRequest},
+		{`{"jsonrpc": "2.0", "method": "Arith.Div", "id": 4, "params": {"A": 1, "B": 0}}`, CodeServerError},
+		{`{"jsonrpc": "2.0", "method": "Arith.Error", "id": 4, "params": {}}`, CodeInternalError},
+		{`{"jsonrpc": "2.0", "method": "Arith.Checked", "id": 4, "params": {}}`, 1000},
+	}
+	for _, test := range errorTests {
+		resp := call(test.request)
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Errorf("%s: expected error code %d, got %+v", test.request, test.code, resp.Error)
+		} else if resp.Result != nil {
+			t.Errorf("%s: unexpected result %+v", test.request, resp.Result)
+		}
+	}
+	if resp := call(`{"jsonrpc": "2.0", "method": "Arith.Checked", "id": 5, "params": {}}`); resp.Error == nil || resp.Error.Data["max"] != "100" {
+		t.Errorf("Checked: expected details in error data, got %+v", resp.Error)
+	}
+
+	// invalid JSON ends the connection after a parse error
+	resp = call(`{"jsonrpc": "2.0", id: 6}`)
+	if resp.Error == nil || resp.Error.Code != CodeParseError || string(resp.Id) != "null" {
+		t.Errorf("expected parse error, got %+v", resp)
+	}
+}
+
+func TestBatch2(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn2(srv)
+	dec := json.NewDecoder(cli)
+
+	fmt.Fprintln(cli, `[
+		{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 1, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 1}},
+		{"jsonrpc": "2.0", "method": "Arith.Unknown", "id": 2, "params": {}},
+		{"jsonrpc": "2.0", "method": "Arith.Mul", "id": 3, "params": [{"A": 3, "B": 4}]},
+		5
+	]`)
+	var resps []response2
+	if err := dec.Decode(&resps); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if len(resps) != 4 {
+		t.Fatalf("expected 4 responses, got %d", len(resps))
+	}
+	byId := make(map[string]response2)
+	for _, resp := range resps {
+		byId[string(resp.Id)] = resp
+	}
+	if resp := byId["1"]; resp.Result == nil || resp.Result.C != 3 {
+		t.Errorf("Add: unexpected response %+v", resp)
+	}
+	if resp := byId["2"]; resp.Error == nil || resp.Error.Code != CodeMethodNotFound {
+		t.Errorf("Unknown: unexpected response %+v", resp)
+	}
+	if resp := byId["3"]; resp.Result == nil || resp.Result.C != 12 {
+		t.Errorf("Mul: unexpected response %+v", resp)
+	}
+	if resp := byId["null"]; resp.Error == nil || resp.Error.Code != CodeInvalidRequest {
+		t.Errorf("invalid request: unexpected response %+v", resp)
+	}
+
+	// a batch of notifications gets no response at all, an empty batch
+	// is an invalid request
+	fmt.Fprintln(cli, `[{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 1}}]`)
+	fmt.Fprintln(cli, `[]`)
+	var resp response2
+	if err := dec.Decode(&resp); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if resp.Error == nil || resp.Error.Code != CodeInvalidRequest || string(resp.Id) != "null" {
+		t.Errorf("empty batch: unexpected response %+v", resp)
+	}
+}
+
+func TestStreamFraming2(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn2(srv)
+	dec := json.NewDecoder(cli)
+
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Thrive", "id": 1, "params": {"A": 3}}`)
+	count, last := readStream(t, dec, "1", 0)
+	if count != 3 || !last.EOS || last.Error != nil || last.Result != nil {
+		t.Fatalf("Thrive: got %d values then %+v", count, last)
+	}
+
+	// the call may be named by position or by name
+	for _, cancel := range []string{
+		`{"jsonrpc": "2.0", "method": "rpc.cancel", "params": ["f"]}`,
+		`{"jsonrpc": "2.0", "method": "rpc.cancel", "params": {"id": "f"}}`,
+	} {
+		fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Forever", "id": "f", "params": {}}`)
+		var first streamResp
+		if err := dec.Decode(&first); err != nil || !first.More {
+			t.Fatalf("Forever: unexpected first response %+v (%v)", first, err)
+		}
+		fmt.Fprintln(cli, cancel)
+		if _, last := readStream(t, dec, `"f"`, 1); !last.EOS || last.Error != nil {
+			t.Fatalf("%s: unexpected last response %+v", cancel, last)
+		}
+	}
+}
+
+func TestDuplicateId2(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn2(srv)
+	dec := json.NewDecoder(cli)
+
+	// another call with the id of a stream in progress is rejected, and
+	// the stream goes on
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Forever", "id": "f", "params": {}}`)
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Add", "id": "f", "params": {"A": 1, "B": 2}}`)
+	resp, next := readRejected(t, dec, `"f"`, 0)
+	if e, ok := resp.Error.(map[string]interface{}); !ok || e["code"] != float64(CodeInvalidRequest) {
+		t.Errorf("Add: expected an invalid request error, got %+v", resp.Error)
+	}
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "rpc.cancel", "params": ["f"]}`)
+	if _, last := readStream(t, dec, `"f"`, next); !last.EOS || last.Error != nil {
+		t.Fatalf("Forever: unexpected last response %+v", last)
+	}
+}
+
+func TestClient2(t *testing.T) {
+	cli, srv := net.Pipe()
+	go ServeConn2(srv)
+
+	client := NewClient2(cli)
+	defer client.Close()
+
+	args := &Args{7, 8}
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", args, reply); err != nil {
+		t.Errorf("Add: expected no error but got %q", err.Error())
+	}
+	if reply.C != args.A+args.B {
+		t.Errorf("Add: expected %d got %d", args.A+args.B, reply.C)
+	}
+
+	err := client.Call("Arith.Div", &Args{7, 0}, reply)
+	if _, ok := err.(rpcplus.ServerError); !ok || err.Error() != "divide by zero" {
+		t.Errorf("Div: expected divide by zero ServerError; got %#v", err)
+	}
+	err = client.Call("Arith.Checked", args, reply)
+	var rpcErr *rpcplus.Error
+	if !errors.As(err, &rpcErr) {
+		t.Errorf("Checked: expected *rpcplus.Error; got %#v", err)
+	} else if rpcErr.Code != 1000 || rpcErr.Message != "too large" || rpcErr.Details["max"] != "100" {
+		t.Errorf("Checked: unexpected error %#v", rpcErr)
+	}
+	err = client.Call("Arith.Unknown", args, reply)
+	if !errors.Is(err, rpcplus.ErrUnknownMethod) {
+		t.Errorf("Unknown: expected ErrUnknownMethod; got %#v", err)
+	}
+
+	// streams work as with JSON-RPC 1.0
+	rowChan := make(chan *Reply, 10)
+	c := client.StreamGo("Arith.Thrive", &Args{5, 0}, rowChan)
+	count := 0
+	for row := range rowChan {
+		if row.C != count {
+			t.Fatal("unexpected value:", row.C)
+		}
+		count++
+	}
+	if c.Error != nil || count != 5 {
+		t.Fatalf("Thrive: got %d values and error %v", count, c.Error)
+	}
+}
@@ -5,12 +5,14 @@
 package jsonrpc
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/shutej/flynn/pkg/rpcplus"
 )
@@ -47,6 +49,16 @@ func (t *Arith) Error(args *Args, reply *Reply) error {
 	panic("ERROR")
 }
 
+func (t *Arith) Checked(args *Args, reply *Reply) error {
+	return &rpcplus.Error{Code: 1000, Message: "too large", Details: map[string]string{"max": "100"}}
+}
+
+func (t *Arith) Metadata(ctx context.Context, args *Args, reply *Reply) error {
+	reply.C = len(rpcplus.MetadataFromContext(ctx))
+	rpcplus.SetResponseMetadata(ctx, "tenant", rpcplus.MetadataFromContext(ctx)["tenant"])
+	return nil
+}
+
 func (t *Arith) Thrive(args *Args, stream rpcplus.Stream) error {
 	for i := 0; i < args.A; i++ {
 		stream.Send <- &Reply{C: i}
@@ -54,6 +66,16 @@ func (t *Arith) Thrive(args *Args, stream rpcplus.Stream) error {
 	return nil
 }
 
+func (t *Arith) Forever(args *Args, stream rpcplus.Stream) error {
+	for i := 0; ; i++ {
+		select {
+		case stream.Send <- &Reply{C: i}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
 func init() {
 	rpcplus.Register(new(Arith))
 }
@@ -81,8 +103,8 @@ func TestServer(t *testing.T) {
 		if resp.Error != nil {
 			t.Fatalf("resp.Error: %s", resp.Error)
 		}
-		if resp.Id.(string) != string(i) {
-			t.Fatalf("resp: bad id %q want %q", resp.Id.(string), string(i))
+		if resp.Id.(string) != string(rune(i)) {
+			t.Fatalf("resp: bad id %q want %q", resp.Id.(string), string(rune(i)))
 		}
 		if resp.Result.C != 2*i+1 {
 			t.Fatalf("resp: bad result: %d+%d=%d", i, i+1, resp.Result.C)
@@ -99,6 +121,34 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestBatch(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn(srv)
+	dec := json.NewDecoder(cli)
+
+	fmt.Fprintln(cli, `[{"method": "Arith.Add", "id": 1, "params": [{"A": 1, "B": 2}]}, {"method": "Arith.Mul", "id": 2, "params": [{"A": 3, "B": 4}]}]`)
+	var resps []struct {
+		Id     int         `json:"id"`
+		Result Reply       `json:"result"`
+		Error  interface{} `json:"error"`
+	}
+	if err := dec.Decode(&resps); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	if len(resps) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(resps))
+	}
+	for _, resp := range resps {
+		if resp.Error != nil {
+			t.Errorf("resp.Error: %s", resp.Error)
+		}
+		if (resp.Id == 1 && resp.Result.C != 3) || (resp.Id == 2 && resp.Result.C != 12) {
+			t.Errorf("resp %d: bad result %d", resp.Id, resp.Result.C)
+		}
+	}
+}
+
 func TestClient(t *testing.T) {
 	// Assume server is okay (TestServer is above).
 	// Test client against server.
@@ -162,6 +212,19 @@ func TestClient(t *testing.T) {
 	} else if err.Error() != "divide by zero" {
 		t.Error("Div: expected divide by zero error; got", err)
 	}
+
+	// Structured errors
+	err = client.Call("Arith.Checked", args, reply)
+	var rpcErr *rpcplus.Error
+	if !errors.As(err, &rpcErr) {
+		t.Errorf("Checked: expected *rpcplus.Error; got %#v", err)
+	} else if rpcErr.Code != 1000 || rpcErr.Message != "too large" || rpcErr.Details["max"] != "100" {
+		t.Errorf("Checked: unexpected error %#v", rpcErr)
+	}
+	err = client.Call("Arith.Unknown", args, reply)
+	if !errors.Is(err, rpcplus.ErrUnknownMethod) {
+		t.Errorf("Unknown: expected ErrUnknownMethod; got %#v", err)
+	}
 }
 
 func TestMalformedInput(t *testing.T) {
@@ -176,6 +239,36 @@ func TestUnexpectedError(t *testing.T) {
 	ServeConn(srv)                                                    // must return, not loop
 }
 
+func TestMetadata(t *testing.T) {
+	cli, srv := net.Pipe()
+	go ServeConn(srv)
+
+	client := NewClient(cli)
+	defer client.Close()
+
+	ctx := rpcplus.WithMetadata(context.Background(), map[string]string{"tenant": "acme", "trace": "abc"})
+	reply := new(Reply)
+	call := <-client.GoContext(ctx, "Arith.Metadata", &Args{}, reply, nil).Done
+	if call.Error != nil {
+		t.Fatal("Metadata:", call.Error)
+	}
+	if reply.C != 2 {
+		t.Errorf("Metadata: expected 2 entries got %d", reply.C)
+	}
+	if tenant := call.ResponseMetadata["tenant"]; tenant != "acme" {
+		t.Errorf("Metadata: expected tenant %q got %q", "acme", tenant)
+	}
+
+	// metadata does not leak into the next request
+	reply = new(Reply)
+	if err := client.Call("Arith.Metadata", &Args{}, reply); err != nil {
+		t.Fatal("Metadata:", err)
+	}
+	if reply.C != 0 {
+		t.Errorf("Metadata: expected no entries got %d", reply.C)
+	}
+}
+
 func TestStreamingCall(t *testing.T) {
 	// Assume server is okay (TestServer is above).
 	// Test client against server.
@@ -209,6 +302,192 @@ func TestStreamingCall(t *testing.T) {
 	}
 }
 
+func TestStreamingCallFlowControl(t *testing.T) {
+	cli, srv := net.Pipe()
+	go ServeConn(srv)
+
+	client := NewClient(cli)
+	defer client.Close()
+	client.SetStreamWindow(2)
+
+	// the stream stalls unless the credit reaches the call
+	args := &Args{50, 0}
+	rowChan := make(chan *Reply)
+	c := client.StreamGo("Arith.Thrive", args, rowChan)
+	count := 0
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case row, ok := <-rowChan:
+			if !ok {
+				done = true
+				break
+			}
+			if row.C != count {
+				t.Fatal("unexpected value:", row.C)
+			}
+			count++
+		case <-timeout:
+			t.Fatal("stream stalled after", count, "values")
+		}
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error.Error())
+	}
+	if count != 50 {
+		t.Fatal("Didn't receive the right number of packets back:", count)
+	}
+}
+
+type streamResp struct {
+	Id     json.RawMessage `json:"id"`
+	Result *Reply          `json:"result"`
+	Error  interface{}     `json:"error"`
+	More   bool            `json:"more"`
+	EOS    bool            `json:"eos"`
+}
+
+// readStream reads the responses to the stream with the given id, the
+// values counting up from the given one, until the last response, which it
+// returns with the number of values before it.
+func readStream(t *testing.T, dec *json.Decoder, id string, from int) (int, streamResp) {
+	for count := 0; ; count++ {
+		var resp streamResp
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		if string(resp.Id) != id {
+			t.Fatalf("resp: bad id %s want %s", resp.Id, id)
+		}
+		if !resp.More {
+			return count, resp
+		}
+		if resp.Result == nil || resp.Result.C != from+count || resp.EOS {
+			t.Fatalf("unexpected intermediate response %+v", resp)
+		}
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn(srv)
+	dec := json.NewDecoder(cli)
+
+	fmt.Fprintln(cli, `{"method": "Arith.Thrive", "id": 1, "params": [{"A": 3, "B": 0}]}`)
+	count, last := readStream(t, dec, "1", 0)
+	if count != 3 || !last.EOS || last.Error != nil || last.Result != nil {
+		t.Fatalf("Thrive: got %d values then %+v", count, last)
+	}
+
+	// a cancel gets no response of its own, the stream ends as usual
+	fmt.Fprintln(cli, `{"method": "Arith.Forever", "id": "f", "params": [{}]}`)
+	var first streamResp
+	if err := dec.Decode(&first); err != nil || !first.More {
+		t.Fatalf("Forever: unexpected first response %+v (%v)", first, err)
+	}
+	fmt.Fprintln(cli, `{"method": "rpc.cancel", "params": ["f"], "id": null}`)
+	if _, last := readStream(t, dec, `"f"`, 1); !last.EOS || last.Error != nil {
+		t.Fatalf("Forever: unexpected last response %+v", last)
+	}
+
+	// cancelling an unknown call does nothing
+	fmt.Fprintln(cli, `{"method": "rpc.cancel", "params": [42], "id": null}`)
+	fmt.Fprintln(cli, `{"method": "Arith.Add", "id": 2, "params": [{"A": 1, "B": 2}]}`)
+	if count, last := readStream(t, dec, "2", 0); count != 0 || last.Result == nil || last.Result.C != 3 || last.EOS {
+		t.Fatalf("Add: unexpected response %+v", last)
+	}
+}
+
+// readRejected reads the values of the stream with the given id, counting
+// up from the given one, until the error response to another request with
+// the same id, which it returns with the value expected next.
+func readRejected(t *testing.T, dec *json.Decoder, id string, from int) (streamResp, int) {
+	for next := from; ; next++ {
+		var resp streamResp
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("Decode: %s", err)
+		}
+		if string(resp.Id) != id {
+			t.Fatalf("resp: bad id %s want %s", resp.Id, id)
+		}
+		if resp.Error != nil {
+			if resp.More || resp.EOS {
+				t.Fatalf("unexpected error response %+v", resp)
+			}
+			return resp, next
+		}
+		if !resp.More || resp.Result == nil || resp.Result.C != next {
+			t.Fatalf("unexpected intermediate response %+v", resp)
+		}
+	}
+}
+
+func TestDuplicateId(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go ServeConn(srv)
+	dec := json.NewDecoder(cli)
+
+	// another call with the id of a stream in progress is rejected, and
+	// the stream goes on
+	fmt.Fprintln(cli, `{"method": "Arith.Forever", "id": "f", "params": [{}]}`)
+	fmt.Fprintln(cli, `{"method": "Arith.Add", "id": "f", "params": [{"A": 1, "B": 2}]}`)
+	resp, next := readRejected(t, dec, `"f"`, 0)
+	if e, ok := resp.Error.(map[string]interface{}); !ok || e["code"] != float64(rpcplus.CodeInvalidRequest) {
+		t.Errorf("Add: expected an invalid request error, got %+v", resp.Error)
+	}
+	fmt.Fprintln(cli, `{"method": "rpc.cancel", "params": ["f"], "id": null}`)
+	if _, last := readStream(t, dec, `"f"`, next); !last.EOS || last.Error != nil {
+		t.Fatalf("Forever: unexpected last response %+v", last)
+	}
+}
+
+func TestCloseStream(t *testing.T) {
+	for name, newClient := range map[string]func(io.ReadWriteCloser) *rpcplus.Client{
+		"1.0": NewClient,
+		"2.0": NewClient2,
+	} {
+		cli, srv := net.Pipe()
+		if name == "1.0" {
+			go ServeConn(srv)
+		} else {
+			go ServeConn2(srv)
+		}
+		client := newClient(cli)
+
+		rowChan := make(chan *Reply)
+		c := client.StreamGo("Arith.Forever", &Args{}, rowChan)
+		if _, ok := <-rowChan; !ok {
+			t.Fatalf("%s: unexpected closed channel", name)
+		}
+		if err := c.CloseStream(); err != nil {
+			t.Fatalf("%s: CloseStream: %s", name, err)
+		}
+		done := make(chan struct{})
+		go func() {
+			for range rowChan {
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: stream was not stopped", name)
+		}
+		if c.Error != nil {
+			t.Errorf("%s: unexpected error %v", name, c.Error)
+		}
+
+		// the connection is still usable
+		reply := new(Reply)
+		if err := client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+			t.Errorf("%s: Add: got %d, %v", name, reply.C, err)
+		}
+		client.Close()
+	}
+}
+
 // Copied from package net.
 func myPipe() (*pipe, *pipe) {
 	r1, w1 := io.Pipe()
@@ -260,3 +539,56 @@ func (p *pipe) SetReadTimeout(nsec int64) error {
 func (p *pipe) SetWriteTimeout(nsec int64) error {
 	return errors.New("net.Pipe does not support timeouts")
 }
+
+func TestShutdownGoAway(t *testing.T) {
+	server := rpcplus.NewServer()
+	server.Register(new(Arith))
+
+	// JSON-RPC 1.0 carries the GoAway response
+	cli, srv := net.Pipe()
+	go server.ServeCodec(NewServerCodec(srv))
+	codec := NewClientCodec(cli)
+	if err := codec.WriteRequest(&rpcplus.Request{ServiceMethod: "Arith.Add", Seq: 0}, &Args{1, 2}); err != nil {
+		t.Fatal("WriteRequest:", err)
+	}
+	var resp rpcplus.Response
+	if err := codec.ReadResponseHeader(&resp); err != nil || resp.Error != "" {
+		t.Fatalf("Add: unexpected response %+v (%v)", resp, err)
+	}
+	codec.ReadResponseBody(nil)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	if err := codec.ReadResponseHeader(&resp); err != nil {
+		t.Fatal("ReadResponseHeader:", err)
+	}
+	if resp.ServiceMethod != rpcplus.GoAwayServiceMethod || resp.Seq != rpcplus.GoAwaySeq {
+		t.Errorf("expected a GoAway response, got %+v", resp)
+	}
+	codec.ReadResponseBody(nil)
+	if err := codec.ReadResponseHeader(&resp); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+
+	// JSON-RPC 2.0 has no message for it
+	server = rpcplus.NewServer()
+	server.Register(new(Arith))
+	cli, srv = net.Pipe()
+	go server.ServeCodec(NewServerCodec2(srv))
+	dec := json.NewDecoder(cli)
+	fmt.Fprintln(cli, `{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 1, "B": 2}}`)
+	var r response2
+	if err := dec.Decode(&r); err != nil || r.Error != nil {
+		t.Fatalf("Add: unexpected response %+v (%v)", r, err)
+	}
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	if err := dec.Decode(&r); err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+}
@@ -0,0 +1,61 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// requestReader reads the requests sent on a connection one at a time, even
+// when they come in a batch: a JSON array of requests.
+type requestReader struct {
+	dec   *json.Decoder
+	queue []json.RawMessage // requests of the current batch yet to be read
+	batch *batch            // the current batch
+}
+
+// next returns the next request and the batch it is part of, if any.  An
+// empty array is returned as a request, to be rejected as invalid.
+func (r *requestReader) next() (json.RawMessage, *batch, error) {
+	if len(r.queue) > 0 {
+		raw := r.queue[0]
+		r.queue = r.queue[1:]
+		return raw, r.batch, nil
+	}
+	var raw json.RawMessage
+	if err := r.dec.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	if raw[0] != '[' {
+		return raw, nil, nil
+	}
+	var requests []json.RawMessage
+	if err := json.Unmarshal(raw, &requests); err != nil || len(requests) == 0 {
+		return raw, nil, nil
+	}
+	r.batch = &batch{pending: len(requests)}
+	r.queue = requests[1:]
+	return requests[0], r.batch, nil
+}
+
+// batch collects the responses to the requests of a batch, which are sent
+// together in an array once every request has been answered.
+type batch struct {
+	mu        sync.Mutex
+	pending   int // requests without their last response
+	responses []json.RawMessage
+}
+
+// add records a response to a request of the batch, nil for requests that
+// get none, such as notifications.  Once the last response to every request
+// has been added, it returns the responses to send, and true.
+func (b *batch) add(resp json.RawMessage, last bool) ([]json.RawMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if resp != nil {
+		b.responses = append(b.responses, resp)
+	}
+	if last {
+		b.pending--
+	}
+	return b.responses, b.pending == 0
+}
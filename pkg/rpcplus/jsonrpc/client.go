@@ -2,8 +2,6 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package jsonrpc implements a JSON-RPC ClientCodec and ServerCodec
-// for the rpc package.
 package jsonrpc
 
 import (
@@ -12,6 +10,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	rpc "github.com/shutej/flynn/pkg/rpcplus"
 )
@@ -44,31 +43,55 @@ func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
 }
 
 type clientRequest struct {
-	Method string         `json:"method"`
-	Params [1]interface{} `json:"params"`
-	Id     uint64         `json:"id"`
+	Method   string            `json:"method"`
+	Params   [1]interface{}    `json:"params"`
+	Id       uint64            `json:"id"`
+	Deadline *time.Time        `json:"deadline,omitempty"`
+	Window   uint32            `json:"window,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 func (c *clientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	if r.ServiceMethod == rpc.CloseStreamServiceMethod {
+		// a notification, as there is no response to it
+		return c.enc.Encode(&cancelRequest{Method: CancelMethod, Params: [1]uint64{r.Seq}, Id: null})
+	}
 	c.mutex.Lock()
-	c.pending[r.Seq] = r.ServiceMethod
+	if _, ok := c.pending[r.Seq]; !ok {
+		// requests controlling a call reuse its id
+		c.pending[r.Seq] = r.ServiceMethod
+	}
 	c.mutex.Unlock()
 	c.req.Method = r.ServiceMethod
 	c.req.Params[0] = param
 	c.req.Id = r.Seq
+	c.req.Deadline = nil
+	if !r.Deadline.IsZero() {
+		c.req.Deadline = &r.Deadline
+	}
+	c.req.Window = r.Window
+	c.req.Metadata = r.Metadata
 	return c.enc.Encode(&c.req)
 }
 
 type clientResponse struct {
-	Id     uint64           `json:"id"`
-	Result *json.RawMessage `json:"result"`
-	Error  interface{}      `json:"error"`
+	Id       uint64            `json:"id"`
+	Result   *json.RawMessage  `json:"result"`
+	Error    *json.RawMessage  `json:"error"`
+	More     bool              `json:"more"`
+	EOS      bool              `json:"eos"`
+	Metadata map[string]string `json:"metadata"`
+	GoAway   bool              `json:"goaway"`
 }
 
 func (r *clientResponse) reset() {
 	r.Id = 0
 	r.Result = nil
 	r.Error = nil
+	r.More = false
+	r.EOS = false
+	r.Metadata = nil
+	r.GoAway = false
 }
 
 func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
@@ -76,18 +99,33 @@ func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
 	if err := c.dec.Decode(&c.resp); err != nil {
 		return err
 	}
+	if c.resp.GoAway {
+		*r = rpc.Response{ServiceMethod: rpc.GoAwayServiceMethod, Seq: rpc.GoAwaySeq}
+		return nil
+	}
 
 	c.mutex.Lock()
 	r.ServiceMethod = c.pending[c.resp.Id]
-	delete(c.pending, c.resp.Id)
+	if !c.resp.More {
+		delete(c.pending, c.resp.Id)
+	}
 	c.mutex.Unlock()
 
 	r.Error = ""
+	r.ErrorCode = rpc.CodeUnknown
+	r.ErrorDetails = nil
+	r.Metadata = c.resp.Metadata
 	r.Seq = c.resp.Id
-	if c.resp.Error != nil {
-		x, ok := c.resp.Error.(string)
-		if !ok {
-			return fmt.Errorf("invalid error %v", c.resp.Error)
+	if c.resp.EOS {
+		r.Error = rpc.EndOfStream
+	} else if c.resp.Error != nil && string(*c.resp.Error) != "null" {
+		var x string
+		if err := json.Unmarshal(*c.resp.Error, &x); err != nil {
+			var e jsonError
+			if err := json.Unmarshal(*c.resp.Error, &e); err != nil {
+				return fmt.Errorf("invalid error %s", *c.resp.Error)
+			}
+			x, r.ErrorCode, r.ErrorDetails = e.Message, e.Code, e.Details
 		}
 		if x == "" {
 			x = "unspecified error"
@@ -98,7 +136,7 @@ func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
 }
 
 func (c *clientCodec) ReadResponseBody(x interface{}) error {
-	if x == nil {
+	if x == nil || c.resp.Result == nil {
 		return nil
 	}
 	return json.Unmarshal(*c.resp.Result, x)
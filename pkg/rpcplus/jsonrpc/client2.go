@@ -0,0 +1,166 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+type clientCodec2 struct {
+	dec *json.Decoder // for reading JSON values
+	enc *json.Encoder // for writing JSON values
+	c   io.Closer
+
+	// temporary work space
+	req  clientRequest2
+	resp clientResponse2
+
+	// As with JSON-RPC 1.0, responses do not include the method.
+	mutex   sync.Mutex        // protects pending
+	pending map[uint64]string // map request id to method name
+}
+
+// NewClientCodec2 returns a new rpc.ClientCodec using JSON-RPC 2.0 on
+// conn.  Arguments that encode as JSON objects are sent as named params,
+// any other argument as the only positional param.
+func NewClientCodec2(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec2{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]string),
+	}
+}
+
+type clientRequest2 struct {
+	Version  string            `json:"jsonrpc"`
+	Method   string            `json:"method"`
+	Params   json.RawMessage   `json:"params,omitempty"`
+	Id       uint64            `json:"id"`
+	Deadline *time.Time        `json:"deadline,omitempty"`
+	Window   uint32            `json:"window,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (c *clientCodec2) WriteRequest(r *rpc.Request, param interface{}) error {
+	params, err := json.Marshal(param)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.Equal(params, null):
+		params = nil
+	case params[0] != '{':
+		params = append(append([]byte{'['}, params...), ']')
+	}
+
+	if r.ServiceMethod == rpc.CloseStreamServiceMethod {
+		// a notification, as there is no response to it
+		return c.enc.Encode(&cancelRequest{Version: "2.0", Method: CancelMethod, Params: [1]uint64{r.Seq}})
+	}
+	c.mutex.Lock()
+	if _, ok := c.pending[r.Seq]; !ok {
+		// requests controlling a call reuse its id
+		c.pending[r.Seq] = r.ServiceMethod
+	}
+	c.mutex.Unlock()
+	c.req.Version = "2.0"
+	c.req.Method = r.ServiceMethod
+	c.req.Params = params
+	c.req.Id = r.Seq
+	c.req.Deadline = nil
+	if !r.Deadline.IsZero() {
+		c.req.Deadline = &r.Deadline
+	}
+	c.req.Window = r.Window
+	c.req.Metadata = r.Metadata
+	return c.enc.Encode(&c.req)
+}
+
+type clientResponse2 struct {
+	Version  string            `json:"jsonrpc"`
+	Id       *uint64           `json:"id"`
+	Result   json.RawMessage   `json:"result"`
+	Error    *jsonError2       `json:"error"`
+	More     bool              `json:"more"`
+	EOS      bool              `json:"eos"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (r *clientResponse2) reset() {
+	*r = clientResponse2{}
+}
+
+func (c *clientCodec2) ReadResponseHeader(r *rpc.Response) error {
+	c.resp.reset()
+	if err := c.dec.Decode(&c.resp); err != nil {
+		return err
+	}
+	if c.resp.Id == nil {
+		// the server could not tell which request failed
+		if c.resp.Error != nil {
+			return fmt.Errorf("jsonrpc: server error %d: %s", c.resp.Error.Code, c.resp.Error.Message)
+		}
+		return fmt.Errorf("jsonrpc: response without id")
+	}
+
+	c.mutex.Lock()
+	r.ServiceMethod = c.pending[*c.resp.Id]
+	if !c.resp.More {
+		delete(c.pending, *c.resp.Id)
+	}
+	c.mutex.Unlock()
+
+	r.Error = ""
+	r.ErrorCode = rpc.CodeUnknown
+	r.ErrorDetails = nil
+	r.Metadata = c.resp.Metadata
+	r.Seq = *c.resp.Id
+	if c.resp.EOS {
+		r.Error = rpc.EndOfStream
+	} else if e := c.resp.Error; e != nil {
+		r.Error = e.Message
+		if r.Error == "" {
+			r.Error = "unspecified error"
+		}
+		r.ErrorCode = rpcErrorCode(e.Code)
+		if len(e.Data) > 0 && !bytes.Equal(e.Data, null) {
+			if err := json.Unmarshal(e.Data, &r.ErrorDetails); err != nil {
+				r.ErrorDetails = map[string]string{"data": string(e.Data)}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *clientCodec2) ReadResponseBody(x interface{}) error {
+	if x == nil || len(c.resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(c.resp.Result, x)
+}
+
+func (c *clientCodec2) Close() error {
+	return c.c.Close()
+}
+
+// NewClient2 returns a new rpc.Client to handle requests to the set of
+// services at the other end of the connection, using JSON-RPC 2.0.
+func NewClient2(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec2(conn))
+}
+
+// Dial2 connects to a JSON-RPC 2.0 server at the specified network address.
+func Dial2(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient2(conn), err
+}
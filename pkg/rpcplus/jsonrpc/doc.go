@@ -0,0 +1,37 @@
+// Package jsonrpc implements a JSON-RPC ClientCodec and ServerCodec
+// for the rpc package.  NewClientCodec and NewServerCodec speak JSON-RPC
+// 1.0, while NewClientCodec2 and NewServerCodec2 speak JSON-RPC 2.0.
+// HTTPHandler serves JSON-RPC 2.0 over plain HTTP POST requests.
+//
+// # Streaming
+//
+// A streaming method answers a request with several responses sharing its
+// id.  Every response but the last carries "more": true:
+//
+//	{"id": 1, "result": {"C": 0}, "error": null, "more": true}
+//
+// The last response carries the error if the method failed.  Otherwise it
+// marks the end of the stream with "eos": true and a null result:
+//
+//	{"id": 1, "result": null, "error": null, "eos": true}
+//
+// With JSON-RPC 2.0 the responses also carry "jsonrpc": "2.0", and no
+// "error" unless there is one.
+//
+// A client stops a stream, or any call in progress, with a cancel request
+// giving the id of the call as its only param.  The cancel request gets no
+// response of its own: the call ends with its last response as usual.
+//
+//	{"method": "rpc.cancel", "params": [1]}
+//
+// # Shutdown
+//
+// A JSON-RPC 1.0 server shutting down tells its clients to stop sending
+// new requests with a response carrying "goaway": true, under an id that
+// no request uses:
+//
+//	{"id": 18446744073709551615, "result": null, "error": null, "goaway": true}
+//
+// JSON-RPC 2.0 has no such message: clients learn of the shutdown from the
+// errors of their new calls, with code CodeUnavailable.
+package jsonrpc
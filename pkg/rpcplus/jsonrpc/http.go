@@ -0,0 +1,168 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// HTTPHandler is an http.Handler answering JSON-RPC 2.0 requests sent as
+// the body of POST requests, for clients that cannot keep a connection
+// hijacked with CONNECT, such as browsers or clients behind proxies.
+//
+// The body holds a request or a batch of requests, and the responses are
+// written as the body of the HTTP response, once the last one is known to
+// the handler.  Responses are separated by newlines, so that the responses
+// of a streaming method form newline-delimited JSON.  Clients accepting
+// text/event-stream get every response as a Server-Sent Event instead.
+// Requests made only of notifications get a 204 No Content response, and
+// requests reaching a server that has been shut down get a 503 Service
+// Unavailable response.
+//
+// The Content-Type of requests must be application/json, which browsers
+// do not send across origins without a CORS preflight, so that other sites
+// cannot call methods on behalf of their visitors.
+//
+// Streams end when the client goes away.  Bodies are read whole before
+// the calls start: use http.MaxBytesHandler to limit their size.
+type HTTPHandler struct {
+	server *rpc.Server
+}
+
+// NewHTTPHandler returns an HTTPHandler dispatching the requests to the
+// services registered with server.
+func NewHTTPHandler(server *rpc.Server) *HTTPHandler {
+	return &HTTPHandler{server}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must POST\n")
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType != "application/json" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		io.WriteString(w, "415 must be application/json\n")
+		return
+	}
+	// HTTP/1.x servers may not read the body once the response has
+	// started, while streams answer before the last request is read
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn := &httpConn{Reader: bytes.NewReader(body), w: w}
+	switch {
+	case accepts(req, "text/event-stream"):
+		conn.sse = true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	case accepts(req, "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	default:
+		w.Header().Set("Content-Type", "application/json")
+	}
+	codec := &httpCodec{serverCodec2: newServerCodec2(conn), done: req.Context().Done()}
+	h.server.ServeCodecWithContext(codec, rpc.ConnContext(req))
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	switch {
+	case !codec.read:
+		// the server has been shut down
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Retry-After", retryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "503 server is shutting down\n")
+	case !conn.wrote:
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// retryAfter is the number of seconds clients are asked to wait before
+// trying again a server that has been shut down, usually to be replaced.
+const retryAfter = "1"
+
+// accepts reports whether the Accept header of req lists mediaType.
+func accepts(req *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// httpCodec serves the requests of a single HTTP request.  Its body ends
+// the connection only once every request has been answered, or the client
+// has gone away, so that the responses are written before the handler
+// returns.
+type httpCodec struct {
+	*serverCodec2
+	done <-chan struct{} // closed when the client goes away
+	read bool            // the server has read requests, rather than refusing them
+}
+
+func (c *httpCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.read = true
+	err := c.serverCodec2.ReadRequestHeader(r)
+	if err != nil {
+		c.wait(c.done)
+	}
+	return err
+}
+
+// httpConn reads the body of an HTTP request and writes the responses to
+// it, each JSON value as written by the codec.  Writes after Close, from
+// streams stopped after the client went away, are dropped.
+type httpConn struct {
+	io.Reader
+	w   http.ResponseWriter
+	sse bool // write Server-Sent Events
+
+	mu     sync.Mutex // protects w, wrote, closed
+	wrote  bool
+	closed bool
+}
+
+func (c *httpConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.wrote = true
+	var err error
+	if c.sse {
+		// p is a single line of JSON ending with a newline
+		_, err = io.WriteString(c.w, "data: "+strings.TrimSuffix(string(p), "\n")+"\n\n")
+	} else {
+		_, err = c.w.Write(p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return len(p), nil
+}
+
+func (c *httpConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
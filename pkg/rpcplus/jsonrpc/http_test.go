@@ -0,0 +1,175 @@
+package jsonrpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shutej/flynn/pkg/rpcplus"
+)
+
+func post(t *testing.T, url, accept, body string) *http.Response {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPHandler(rpcplus.DefaultServer))
+	defer srv.Close()
+
+	resp := post(t, srv.URL, "", `{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 3, "B": 4}}`)
+	var r response2
+	err := json.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if r.Error != nil || r.Result == nil || r.Result.C != 7 || string(r.Id) != "1" {
+		t.Errorf("Add: unexpected response %+v", r)
+	}
+
+	// a batch gets an array of responses
+	resp = post(t, srv.URL, "", `[
+		{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 1, "B": 2}},
+		{"jsonrpc": "2.0", "method": "Arith.Mul", "id": 2, "params": {"A": 3, "B": 4}}
+	]`)
+	var rs []response2
+	err = json.NewDecoder(resp.Body).Decode(&rs)
+	resp.Body.Close()
+	if err != nil || len(rs) != 2 {
+		t.Fatalf("batch: got %d responses, %v", len(rs), err)
+	}
+
+	// notifications get no content
+	resp = post(t, srv.URL, "", `{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 2}}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("notification: unexpected status %s", resp.Status)
+	}
+
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: unexpected status %s", resp.Status)
+	}
+
+	// a form may be posted across origins without a preflight
+	for _, ct := range []string{"", "text/plain"} {
+		resp, err = http.Post(srv.URL, ct, strings.NewReader(`{"jsonrpc": "2.0", "method": "Arith.Add", "id": 1, "params": {"A": 1, "B": 2}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("Content-Type %q: unexpected status %s", ct, resp.Status)
+		}
+	}
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	server := rpcplus.NewServer()
+	server.Register(new(Arith))
+	srv := httptest.NewServer(NewHTTPHandler(server))
+	defer srv.Close()
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+
+	// unlike notifications, the requests are not served
+	resp := post(t, srv.URL, "", `{"jsonrpc": "2.0", "method": "Arith.Add", "params": {"A": 1, "B": 2}}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("unexpected response %s, Retry-After %q", resp.Status, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPHandler(rpcplus.DefaultServer))
+	defer srv.Close()
+
+	request := `{"jsonrpc": "2.0", "method": "Arith.Thrive", "id": 1, "params": {"A": 3}}`
+	resp := post(t, srv.URL, "application/x-ndjson", request)
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	count, last := readStream(t, json.NewDecoder(resp.Body), "1", 0)
+	resp.Body.Close()
+	if count != 3 || !last.EOS {
+		t.Errorf("Thrive: got %d values then %+v", count, last)
+	}
+
+	resp = post(t, srv.URL, "text/event-stream", request)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	events := strings.Split(strings.TrimSuffix(string(body), "\n\n"), "\n\n")
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %q", body)
+	}
+	for i, event := range events {
+		var r streamResp
+		if !strings.HasPrefix(event, "data: ") {
+			t.Fatalf("unexpected event %q", event)
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &r); err != nil {
+			t.Fatalf("event %q: %s", event, err)
+		}
+		if r.More != (i < 3) || r.EOS != (i == 3) {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+}
+
+func TestHTTPStreamClientGone(t *testing.T) {
+	srv := httptest.NewServer(NewHTTPHandler(rpcplus.DefaultServer))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL, strings.NewReader(`{"jsonrpc": "2.0", "method": "Arith.Forever", "id": 1, "params": {}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal("ReadString:", err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	// Close waits for the handler to return
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client went away")
+	}
+}
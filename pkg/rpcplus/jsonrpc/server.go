@@ -8,15 +8,17 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"strconv"
 	"sync"
+	"time"
 
 	rpc "github.com/shutej/flynn/pkg/rpcplus"
 )
 
 type serverCodec struct {
-	dec *json.Decoder // for reading JSON values
-	enc *json.Encoder // for writing JSON values
-	c   io.Closer
+	reader requestReader // for reading requests, batched or not
+	enc    *json.Encoder // for writing JSON values
+	c      io.Closer
 
 	// temporary work space
 	req  serverRequest
@@ -28,29 +30,58 @@ type serverCodec struct {
 	// but save the original request ID in the pending map.
 	// When rpc responds, we use the sequence number in
 	// the response to find the original request ID.
-	mutex   sync.Mutex // protects seq, pending
+	// Requests controlling a call in progress (such as CloseStream)
+	// reuse its ID, which active maps back to its sequence number.
+	// The requests that came in a batch are found in batches.
+	mutex   sync.Mutex // protects seq, pending, active, batches
 	seq     uint64
 	pending map[uint64]*json.RawMessage
+	active  map[string]uint64
+	batches map[uint64]*batch
+
+	encMutex sync.Mutex // protects enc
+}
+
+// MediaType is the media type the JSON-RPC 1.0 codec is registered under
+// with rpc.RegisterCodec.
+const MediaType = "application/vnd.flynn.rpc-hijack+json"
+
+func init() {
+	rpc.RegisterCodec(MediaType, rpc.Codec{
+		NewClientCodec: NewClientCodec,
+		NewServerCodec: NewServerCodec,
+		Text:           true,
+	})
 }
 
 // NewServerCodec returns a new rpc.ServerCodec using JSON-RPC on conn.
+// The calls of a batch, an array of requests, run concurrently and their
+// responses are sent together in an array.
 func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
 	return &serverCodec{
-		dec:     json.NewDecoder(conn),
+		reader:  requestReader{dec: json.NewDecoder(conn)},
 		enc:     json.NewEncoder(conn),
 		c:       conn,
 		pending: make(map[uint64]*json.RawMessage),
+		active:  make(map[string]uint64),
+		batches: make(map[uint64]*batch),
 	}
 }
 
 type serverRequest struct {
-	Method string           `json:"method"`
-	Params *json.RawMessage `json:"params"`
-	Id     *json.RawMessage `json:"id"`
+	Method   string            `json:"method"`
+	Params   *json.RawMessage  `json:"params"`
+	Id       *json.RawMessage  `json:"id"`
+	Deadline *time.Time        `json:"deadline"`
+	Window   uint32            `json:"window"`
+	Metadata map[string]string `json:"metadata"`
 }
 
 func (r *serverRequest) reset() {
 	r.Method = ""
+	r.Deadline = nil
+	r.Window = 0
+	r.Metadata = nil
 	if r.Params != nil {
 		*r.Params = (*r.Params)[0:0]
 	}
@@ -60,24 +91,93 @@ func (r *serverRequest) reset() {
 }
 
 type serverResponse struct {
-	Id     *json.RawMessage `json:"id"`
-	Result interface{}      `json:"result"`
-	Error  interface{}      `json:"error"`
+	Id       *json.RawMessage  `json:"id"`
+	Result   interface{}       `json:"result"`
+	Error    interface{}       `json:"error"`
+	More     bool              `json:"more,omitempty"` // more responses follow
+	EOS      bool              `json:"eos,omitempty"`  // the stream ended successfully
+	Metadata map[string]string `json:"metadata,omitempty"`
+	GoAway   bool              `json:"goaway,omitempty"` // the server is shutting down
+}
+
+// jsonError is the form of errors that carry a code or details.
+// Other errors are sent as plain strings.
+type jsonError struct {
+	Code    rpc.ErrorCode     `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
 }
 
 func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
 	c.req.reset()
-	if err := c.dec.Decode(&c.req); err != nil {
+	raw, batch, err := c.reader.next()
+	if err != nil {
 		return err
 	}
+	if err := json.Unmarshal(raw, &c.req); err != nil {
+		if batch == nil {
+			return err
+		}
+		// rejected as ill-formed, in the response to the batch
+		c.req.Method = ""
+	}
 	r.ServiceMethod = c.req.Method
+	if c.req.Deadline != nil {
+		r.Deadline = *c.req.Deadline
+	}
+	r.Window = c.req.Window
+	r.Metadata = c.req.Metadata
+
+	if c.req.Method == CancelMethod {
+		// stop the call in progress; unknown ones are ignored
+		// as sequence numbers start at 1
+		r.ServiceMethod = rpc.CloseStreamServiceMethod
+		r.Seq = 0
+		c.mutex.Lock()
+		if c.req.Params != nil {
+			if id, ok := cancelTarget(*c.req.Params); ok {
+				r.Seq = c.active[idKey(id)]
+			}
+		}
+		c.mutex.Unlock()
+		if batch != nil {
+			c.addToBatch(batch, nil, true)
+		}
+		return nil
+	}
 
 	// JSON request id can be any JSON value;
 	// RPC package expects uint64.  Translate to
 	// internal uint64 and save JSON on the side.
 	c.mutex.Lock()
+	tracked := c.req.Id != nil
+	if tracked {
+		if seq, ok := c.active[idKey(*c.req.Id)]; ok {
+			if rpc.IsControlMethod(r.ServiceMethod) {
+				// the request controls a call in progress
+				// and gets no response of its own
+				r.Seq = seq
+				c.mutex.Unlock()
+				if batch != nil {
+					c.addToBatch(batch, nil, true)
+				}
+				return nil
+			}
+			// another call cannot reuse the id: package rpc
+			// rejects the request as ill-formed, leaving the
+			// call alone
+			r.ServiceMethod = ""
+			tracked = false
+		}
+	}
 	c.seq++
 	c.pending[c.seq] = c.req.Id
+	if tracked {
+		c.active[idKey(*c.req.Id)] = c.seq
+	}
+	if batch != nil {
+		c.batches[c.seq] = batch
+	}
 	c.req.Id = nil
 	r.Seq = c.seq
 	c.mutex.Unlock()
@@ -100,16 +200,33 @@ func (c *serverCodec) ReadRequestBody(x interface{}) error {
 
 var null = json.RawMessage([]byte("null"))
 
+// goAwayId is the id of GoAway responses, which no request uses.
+var goAwayId = json.RawMessage(strconv.FormatUint(rpc.GoAwaySeq, 10))
+
 func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}, last bool) error {
 	var resp serverResponse
+	if r.Seq == rpc.GoAwaySeq && r.ServiceMethod == rpc.GoAwayServiceMethod {
+		resp.Id = &goAwayId
+		resp.GoAway = true
+		c.encMutex.Lock()
+		defer c.encMutex.Unlock()
+		return c.enc.Encode(resp)
+	}
 	c.mutex.Lock()
 	b, ok := c.pending[r.Seq]
 	if !ok {
 		c.mutex.Unlock()
 		return errors.New("invalid sequence number in response")
 	}
+	batch := c.batches[r.Seq]
 	if last {
 		delete(c.pending, r.Seq)
+		delete(c.batches, r.Seq)
+		if b != nil {
+			if seq, ok := c.active[idKey(*b)]; ok && seq == r.Seq {
+				delete(c.active, idKey(*b))
+			}
+		}
 	}
 	c.mutex.Unlock()
 
@@ -119,14 +236,41 @@ func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}, last bool) e
 	}
 	resp.Id = b
 	resp.Result = x
+	resp.More = !last
+	resp.Metadata = r.Metadata
 	if r.Error == "" {
 		resp.Error = nil
+	} else if r.Error == rpc.EndOfStream {
+		resp.Result = nil
+		resp.EOS = true
+	} else if r.ErrorCode != rpc.CodeUnknown || r.ErrorDetails != nil {
+		resp.Error = &jsonError{r.ErrorCode, r.Error, r.ErrorDetails}
 	} else {
 		resp.Error = r.Error
 	}
+	if batch != nil {
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		return c.addToBatch(batch, b, last)
+	}
+	c.encMutex.Lock()
+	defer c.encMutex.Unlock()
 	return c.enc.Encode(resp)
 }
 
+// addToBatch adds a response to its batch, sending the batch once it is
+// complete.
+func (c *serverCodec) addToBatch(b *batch, resp json.RawMessage, last bool) error {
+	if responses, done := b.add(resp, last); done && len(responses) > 0 {
+		c.encMutex.Lock()
+		defer c.encMutex.Unlock()
+		return c.enc.Encode(responses)
+	}
+	return nil
+}
+
 func (c *serverCodec) Close() error {
 	return c.c.Close()
 }
@@ -0,0 +1,361 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// The error codes defined by JSON-RPC 2.0.
+const (
+	CodeParseError        = -32700 // the request is not valid JSON
+	CodeInvalidRequest    = -32600 // the request is not a valid request object
+	CodeMethodNotFound    = -32601 // the method does not exist
+	CodeInvalidParams     = -32602 // the params could not be decoded
+	CodeInternalError     = -32603 // the method failed unexpectedly
+	CodeServerError       = -32000 // any other error without a code
+	CodeUnavailable       = -32001 // the server is shutting down
+	CodeResourceExhausted = -32002 // the call exceeded a limit of the server
+)
+
+// errorCode2 returns the JSON-RPC 2.0 code of an error with the given rpc
+// code.  Codes chosen by services are sent as they are.
+func errorCode2(code rpc.ErrorCode) int {
+	switch code {
+	case rpc.CodeUnknown:
+		return CodeServerError
+	case rpc.CodeInvalidRequest:
+		return CodeInvalidRequest
+	case rpc.CodeUnknownService, rpc.CodeUnknownMethod:
+		return CodeMethodNotFound
+	case rpc.CodeBadArgument:
+		return CodeInvalidParams
+	case rpc.CodeInternal:
+		return CodeInternalError
+	case rpc.CodeUnavailable:
+		return CodeUnavailable
+	case rpc.CodeResourceExhausted:
+		return CodeResourceExhausted
+	}
+	return int(code)
+}
+
+// rpcErrorCode is the reverse of errorCode2.
+func rpcErrorCode(code int) rpc.ErrorCode {
+	switch code {
+	case CodeServerError:
+		return rpc.CodeUnknown
+	case CodeParseError, CodeInvalidRequest:
+		return rpc.CodeInvalidRequest
+	case CodeMethodNotFound:
+		return rpc.CodeUnknownMethod
+	case CodeInvalidParams:
+		return rpc.CodeBadArgument
+	case CodeInternalError:
+		return rpc.CodeInternal
+	case CodeUnavailable:
+		return rpc.CodeUnavailable
+	case CodeResourceExhausted:
+		return rpc.CodeResourceExhausted
+	}
+	return rpc.ErrorCode(code)
+}
+
+type serverCodec2 struct {
+	reader requestReader // for reading requests, batched or not
+	enc    *json.Encoder // for writing JSON values
+	c      io.Closer
+
+	// temporary work space
+	req serverRequest2
+
+	// As with JSON-RPC 1.0, request IDs are arbitrary JSON values saved
+	// in pending under the sequence number given to package rpc.  Requests
+	// controlling a call in progress reuse its ID, which active maps back
+	// to its sequence number.
+	mutex   sync.Mutex // protects seq, pending, active, unanswered
+	seq     uint64
+	pending map[uint64]pendingRequest2
+	active  map[string]uint64
+
+	// unanswered counts the requests read without their last response
+	// written, and answered is signalled whenever it goes down: see wait.
+	unanswered int
+	answered   chan struct{}
+
+	encMutex sync.Mutex // protects enc
+}
+
+// pendingRequest2 is a request waiting for its response.
+type pendingRequest2 struct {
+	id     json.RawMessage // null for invalid requests
+	notify bool            // a notification gets no response
+	batch  *batch          // the batch of the request, if any
+}
+
+// NewServerCodec2 returns a new rpc.ServerCodec using JSON-RPC 2.0 on conn.
+// Params may be given by position, as an array holding the argument, or by
+// name, as an object decoded into the argument.  Requests without an id are
+// notifications: the method is called but no response is sent.  The calls
+// of a batch, an array of requests, run concurrently and their responses
+// are sent together in an array.
+func NewServerCodec2(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return newServerCodec2(conn)
+}
+
+func newServerCodec2(conn io.ReadWriteCloser) *serverCodec2 {
+	return &serverCodec2{
+		reader:   requestReader{dec: json.NewDecoder(conn)},
+		enc:      json.NewEncoder(conn),
+		c:        conn,
+		pending:  make(map[uint64]pendingRequest2),
+		active:   make(map[string]uint64),
+		answered: make(chan struct{}, 1),
+	}
+}
+
+type serverRequest2 struct {
+	Version  string            `json:"jsonrpc"`
+	Method   string            `json:"method"`
+	Params   json.RawMessage   `json:"params"`
+	Id       json.RawMessage   `json:"id"`
+	Deadline *time.Time        `json:"deadline"`
+	Window   uint32            `json:"window"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (r *serverRequest2) reset() {
+	*r = serverRequest2{}
+}
+
+type serverResponse2 struct {
+	Version  string            `json:"jsonrpc"`
+	Id       json.RawMessage   `json:"id"`
+	Result   interface{}       `json:"result,omitempty"`
+	Error    *jsonError2       `json:"error,omitempty"`
+	More     bool              `json:"more,omitempty"` // more responses follow
+	EOS      bool              `json:"eos,omitempty"`  // the stream ended successfully
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// jsonError2 is a JSON-RPC 2.0 error object.  The details of an *rpc.Error
+// are sent as its data.
+type jsonError2 struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (c *serverCodec2) ReadRequestHeader(r *rpc.Request) error {
+	c.req.reset()
+	raw, batch, err := c.reader.next()
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// the stream cannot be read any further
+			c.write(&serverResponse2{Version: "2.0", Id: null, Error: &jsonError2{Code: CodeParseError, Message: "parse error: " + err.Error()}})
+		}
+		return err
+	}
+	if err := json.Unmarshal(raw, &c.req); err != nil {
+		// valid JSON, but not a request object
+		c.req.Method = ""
+	}
+	r.ServiceMethod = c.req.Method
+	if c.req.Deadline != nil {
+		r.Deadline = *c.req.Deadline
+	}
+	r.Window = c.req.Window
+	r.Metadata = c.req.Metadata
+
+	if c.req.Method == CancelMethod {
+		// stop the call in progress; unknown ones are ignored
+		// as sequence numbers start at 1
+		r.ServiceMethod = rpc.CloseStreamServiceMethod
+		r.Seq = 0
+		c.mutex.Lock()
+		if id, ok := cancelTarget(c.req.Params); ok {
+			r.Seq = c.active[idKey(id)]
+		}
+		c.mutex.Unlock()
+		if batch != nil {
+			c.addToBatch(batch, nil, true)
+		}
+		return nil
+	}
+
+	id := c.req.Id
+	p := pendingRequest2{id: id, notify: len(id) == 0, batch: batch}
+	if c.req.Version != "2.0" || c.req.Method == "" {
+		// package rpc rejects the request as ill-formed
+		r.ServiceMethod = ""
+		p.notify = false
+		if len(id) == 0 {
+			p.id = null
+		}
+	}
+
+	// a null id cannot tell requests apart
+	tracked := !p.notify && r.ServiceMethod != "" && string(id) != "null"
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if seq, ok := c.active[idKey(id)]; ok && tracked {
+		if rpc.IsControlMethod(r.ServiceMethod) {
+			// the request controls a call in progress and gets
+			// no response of its own
+			r.Seq = seq
+			if batch != nil {
+				c.addToBatch(batch, nil, true)
+			}
+			return nil
+		}
+		// another call cannot reuse the id: package rpc rejects
+		// the request as ill-formed, leaving the call alone
+		r.ServiceMethod = ""
+		tracked = false
+	}
+	c.seq++
+	c.pending[c.seq] = p
+	c.unanswered++
+	if tracked {
+		c.active[idKey(id)] = c.seq
+	}
+	r.Seq = c.seq
+	return nil
+}
+
+func (c *serverCodec2) ReadRequestBody(x interface{}) error {
+	if x == nil || len(c.req.Params) == 0 || string(c.req.Params) == "null" {
+		return nil
+	}
+	if c.req.Params[0] == '[' {
+		// by position: the argument is the only element
+		var params []json.RawMessage
+		if err := json.Unmarshal(c.req.Params, &params); err != nil {
+			return err
+		}
+		if len(params) != 1 {
+			return errors.New("jsonrpc: expected a single positional param")
+		}
+		return json.Unmarshal(params[0], x)
+	}
+	// by name: the object is the argument
+	return json.Unmarshal(c.req.Params, x)
+}
+
+func (c *serverCodec2) WriteResponse(r *rpc.Response, x interface{}, last bool) error {
+	if r.Seq == rpc.GoAwaySeq && r.ServiceMethod == rpc.GoAwayServiceMethod {
+		// JSON-RPC 2.0 has no message for it
+		return nil
+	}
+	c.mutex.Lock()
+	p, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	if last {
+		defer c.answer()
+		delete(c.pending, r.Seq)
+		if seq, ok := c.active[idKey(p.id)]; ok && seq == r.Seq {
+			delete(c.active, idKey(p.id))
+		}
+	}
+	c.mutex.Unlock()
+
+	if p.notify {
+		if p.batch != nil {
+			return c.addToBatch(p.batch, nil, last)
+		}
+		return nil
+	}
+	resp := &serverResponse2{Version: "2.0", Id: p.id, More: !last, Metadata: r.Metadata}
+	if r.Error == "" {
+		if x == nil {
+			x = null
+		}
+		resp.Result = x
+	} else if r.Error == rpc.EndOfStream {
+		resp.Result = null
+		resp.EOS = true
+	} else {
+		resp.Error = &jsonError2{Code: errorCode2(r.ErrorCode), Message: r.Error}
+		if r.ErrorDetails != nil {
+			resp.Error.Data, _ = json.Marshal(r.ErrorDetails)
+		}
+	}
+	if p.batch != nil {
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		return c.addToBatch(p.batch, b, last)
+	}
+	return c.write(resp)
+}
+
+// answer records that a request got its last response.
+func (c *serverCodec2) answer() {
+	c.mutex.Lock()
+	c.unanswered--
+	c.mutex.Unlock()
+	select {
+	case c.answered <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits until every request read so far has been answered, or until
+// done is closed.
+func (c *serverCodec2) wait(done <-chan struct{}) {
+	for {
+		c.mutex.Lock()
+		n := c.unanswered
+		c.mutex.Unlock()
+		if n == 0 {
+			return
+		}
+		select {
+		case <-c.answered:
+		case <-done:
+			return
+		}
+	}
+}
+
+// addToBatch adds a response to its batch, sending the batch once it is
+// complete.
+func (c *serverCodec2) addToBatch(b *batch, resp json.RawMessage, last bool) error {
+	if responses, done := b.add(resp, last); done && len(responses) > 0 {
+		return c.write(responses)
+	}
+	return nil
+}
+
+func (c *serverCodec2) write(v interface{}) error {
+	c.encMutex.Lock()
+	defer c.encMutex.Unlock()
+	return c.enc.Encode(v)
+}
+
+func (c *serverCodec2) Close() error {
+	return c.c.Close()
+}
+
+// ServeConn2 runs the JSON-RPC 2.0 server on a single connection.
+// ServeConn2 blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConn2 in a go statement.
+func ServeConn2(conn io.ReadWriteCloser) {
+	ServeConnWithContext2(conn, nil)
+}
+
+// ServeConnWithContext2 is like ServeConn2 but it allows to pass a
+// connection context to the RPC methods.
+func ServeConnWithContext2(conn io.ReadWriteCloser, context interface{}) {
+	rpc.ServeCodecWithContext(NewServerCodec2(conn), context)
+}
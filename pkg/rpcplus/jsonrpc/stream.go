@@ -0,0 +1,47 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// CancelMethod is the method of the request stopping a call in progress.
+// See the package documentation.
+const CancelMethod = "rpc.cancel"
+
+// idKey returns the key of a request id in the map of calls in progress,
+// so that a cancel request may write the id differently.
+func idKey(id json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, id); err != nil {
+		return string(id)
+	}
+	return b.String()
+}
+
+// cancelTarget returns the id of the call to stop given the params of a
+// cancel request: [id], or {"id": id} with JSON-RPC 2.0.
+func cancelTarget(params json.RawMessage) (json.RawMessage, bool) {
+	var byPosition []json.RawMessage
+	if err := json.Unmarshal(params, &byPosition); err == nil {
+		if len(byPosition) != 1 {
+			return nil, false
+		}
+		return byPosition[0], true
+	}
+	var byName struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(params, &byName); err == nil && len(byName.Id) > 0 {
+		return byName.Id, true
+	}
+	return nil, false
+}
+
+// cancelRequest is the notification sent by clients to cancel a call.
+type cancelRequest struct {
+	Version string          `json:"jsonrpc,omitempty"`
+	Method  string          `json:"method"`
+	Params  [1]uint64       `json:"params"`
+	Id      json.RawMessage `json:"id,omitempty"` // null for JSON-RPC 1.0
+}
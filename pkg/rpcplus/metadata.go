@@ -0,0 +1,87 @@
+package rpcplus
+
+import (
+	"context"
+	"sync"
+)
+
+type outgoingMetadataKey struct{}
+
+type incomingMetadataKey struct{}
+
+// WithMetadata returns a copy of ctx carrying metadata, added to any already
+// there.  CallContext and GoContext send it with the request, for instance
+// to pass an authentication token or a trace ID.
+func WithMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	md := make(map[string]string)
+	for k, v := range outgoingMetadata(ctx) {
+		md[k] = v
+	}
+	for k, v := range metadata {
+		md[k] = v
+	}
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+func outgoingMetadata(ctx context.Context) map[string]string {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(map[string]string)
+	return md
+}
+
+// callMetadata is the metadata of a call in progress on a server.
+type callMetadata struct {
+	request map[string]string
+
+	mu       sync.Mutex // protects response
+	response map[string]string
+}
+
+// responseMetadata returns a copy of the metadata set by the method so far.
+func (md *callMetadata) responseMetadata() map[string]string {
+	if md == nil {
+		return nil
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.response == nil {
+		return nil
+	}
+	response := make(map[string]string, len(md.response))
+	for k, v := range md.response {
+		response[k] = v
+	}
+	return response
+}
+
+func incomingMetadata(ctx context.Context) *callMetadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(*callMetadata)
+	return md
+}
+
+// MetadataFromContext returns the metadata the client sent with the request,
+// given the context.Context passed to a method (or to an interceptor in
+// ServerCall.Context).  It returns nil if there is none.
+func MetadataFromContext(ctx context.Context) map[string]string {
+	if md := incomingMetadata(ctx); md != nil {
+		return md.request
+	}
+	return nil
+}
+
+// SetResponseMetadata sets metadata sent back to the client with the final
+// response of the call, where it appears in Call.ResponseMetadata.  ctx is
+// the context.Context passed to the method.  It reports whether ctx belongs
+// to a call.
+func SetResponseMetadata(ctx context.Context, key, value string) bool {
+	md := incomingMetadata(ctx)
+	if md == nil {
+		return false
+	}
+	md.mu.Lock()
+	if md.response == nil {
+		md.response = make(map[string]string)
+	}
+	md.response[key] = value
+	md.mu.Unlock()
+	return true
+}
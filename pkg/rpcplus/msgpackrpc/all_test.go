@@ -0,0 +1,117 @@
+package msgpackrpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+	"github.com/shutej/flynn/pkg/rpcplus/internal/reflectcodec"
+	"github.com/shutej/flynn/pkg/rpcplus/rpctest"
+)
+
+func TestConformance(t *testing.T) {
+	rpctest.TestCodec(t, rpc.Codec{NewClientCodec: NewClientCodec, NewServerCodec: NewServerCodec})
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	var b bytes.Buffer
+	if err := reflectcodec.Encode(format.NewWriter(&b), v); err != nil {
+		t.Fatalf("encoding %#v: %v", v, err)
+	}
+	return b.Bytes()
+}
+
+func decode(b []byte, v interface{}) error {
+	return reflectcodec.Decode(format.NewReader(bufio.NewReader(bytes.NewReader(b))), v)
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xcc, 0x80}},
+		{uint16(256), []byte{0xcd, 0x01, 0x00}},
+		{1 << 32, []byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{-129, []byte{0xd1, 0xff, 0x7f}},
+		{int64(math.MinInt64), []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{float32(1.5), []byte{0xca, 0x3f, 0xc0, 0, 0}},
+		{"abc", []byte{0xa3, 'a', 'b', 'c'}},
+		{[]byte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{[]int{1, 2}, []byte{0x92, 1, 2}},
+		{map[string]bool{"a": false}, []byte{0x81, 0xa1, 'a', 0xc2}},
+		{struct {
+			A int `codec:"a"`
+			B int `codec:"b,omitempty"`
+			c int
+		}{A: 1}, []byte{0x81, 0xa1, 'a', 1}},
+	}
+	for _, test := range tests {
+		if b := encode(t, test.v); !bytes.Equal(b, test.want) {
+			t.Errorf("%#v: got % x, want % x", test.v, b, test.want)
+		}
+		if test.v == nil {
+			continue
+		}
+		got := reflect.New(reflect.TypeOf(test.v))
+		if err := decode(test.want, got.Interface()); err != nil {
+			t.Errorf("decoding % x: %v", test.want, err)
+		} else if !reflect.DeepEqual(got.Elem().Interface(), test.v) {
+			t.Errorf("decoding % x: got %#v, want %#v", test.want, got.Elem().Interface(), test.v)
+		}
+	}
+
+	// longer encodings are accepted, and unknown fields skipped
+	var args rpctest.Args
+	b := []byte{0x83, 0xd9, 1, 'A', 0xd2, 0, 0, 0, 7, 0xa1, 'x', 0x91, 0x90, 0xa1, 'b', 0xcd, 0, 8}
+	if err := decode(b, &args); err != nil || args != (rpctest.Args{A: 7, B: 8}) {
+		t.Errorf("got %+v, %v", args, err)
+	}
+
+	var x interface{}
+	if err := decode([]byte{0x82, 0xa1, 'a', 0x92, 1, 0xff, 0xa1, 'b', 0xc4, 1, 9}, &x); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": []interface{}{int64(1), int64(-1)}, "b": []byte{9}}; !reflect.DeepEqual(x, want) {
+		t.Errorf("got %#v, want %#v", x, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var n int8
+	var typeErr *reflectcodec.TypeError
+	if err := decode([]byte{0xcc, 0x80}, &n); !errors.As(err, &typeErr) {
+		t.Errorf("overflow: expected a TypeError, got %v", err)
+	}
+	var s string
+	if err := decode([]byte{0xa3, 'a'}, &s); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated string: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := decode([]byte{0x92, 1}, nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated array: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	if err := decode([]byte{0xd4, 0, 0}, nil); err == nil {
+		t.Error("expected an error for an extension type")
+	}
+
+	// the value following a mismatched one is read from where it starts
+	r := format.NewReader(bufio.NewReader(bytes.NewReader([]byte{0x81, 0xa1, 'a', 0x91, 1, 0xa1, 'b'})))
+	if err := reflectcodec.Decode(r, &n); !errors.As(err, &typeErr) {
+		t.Errorf("map into int8: expected a TypeError, got %v", err)
+	}
+	if err := reflectcodec.Decode(r, &s); err != nil || s != "b" {
+		t.Errorf("got %q, %v", s, err)
+	}
+}
@@ -0,0 +1,68 @@
+// Package msgpackrpc implements a MessagePack ClientCodec and ServerCodec
+// for the rpc package, so that services can be called from other
+// languages without the cost of JSON.
+//
+// Every request is a header map followed by the arguments, and every
+// response a header map followed by the reply.  The keys of the headers
+// are the field names of the RequestHeader and ResponseHeader messages of
+// protorpc's rpc.proto, which describes the control requests too; the
+// deadline is in nanoseconds since the Unix epoch.  Structs are encoded as
+// maps keyed by field name, which a `codec:"name"` tag may change.
+package msgpackrpc
+
+import (
+	"io"
+	"net"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// MediaType is the media type the codec is registered under with
+// rpc.RegisterCodec.
+const MediaType = "application/vnd.flynn.rpc-hijack+msgpack"
+
+func init() {
+	rpc.RegisterCodec(MediaType, rpc.Codec{
+		NewClientCodec: NewClientCodec,
+		NewServerCodec: NewServerCodec,
+	})
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using MessagePack on conn.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return format.NewServerCodec(conn)
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using MessagePack on conn.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return format.NewClientCodec(conn)
+}
+
+// NewClient returns a new rpc.Client to handle requests to the
+// set of services at the other end of the connection.
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn))
+}
+
+// Dial connects to a MessagePack RPC server at the specified network
+// address.
+func Dial(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), err
+}
+
+// ServeConn runs the MessagePack server on a single connection.
+// ServeConn blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConn in a go statement.
+func ServeConn(conn io.ReadWriteCloser) {
+	rpc.ServeCodec(NewServerCodec(conn))
+}
+
+// ServeConnWithContext is like ServeConn but it allows to pass a
+// connection context to the RPC methods.
+func ServeConnWithContext(conn io.ReadWriteCloser, context interface{}) {
+	rpc.ServeCodecWithContext(NewServerCodec(conn), context)
+}
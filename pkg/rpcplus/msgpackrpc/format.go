@@ -0,0 +1,225 @@
+package msgpackrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/shutej/flynn/pkg/rpcplus/internal/reflectcodec"
+)
+
+var format = reflectcodec.Format{
+	NewReader: func(r *bufio.Reader) reflectcodec.Reader { return reader{r} },
+	NewWriter: func(b *bytes.Buffer) reflectcodec.Writer { return writer{b} },
+}
+
+// writer writes MessagePack, always in the shortest encoding.
+type writer struct {
+	b *bytes.Buffer
+}
+
+func (w writer) byte1(c byte, v uint8) {
+	w.b.Write([]byte{c, v})
+}
+
+func (w writer) byte2(c byte, v uint16) {
+	w.b.Write([]byte{c, byte(v >> 8), byte(v)})
+}
+
+func (w writer) byte4(c byte, v uint32) {
+	w.b.Write([]byte{c, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+func (w writer) byte8(c byte, v uint64) {
+	var b [9]byte
+	b[0] = c
+	binary.BigEndian.PutUint64(b[1:], v)
+	w.b.Write(b[:])
+}
+
+func (w writer) WriteNil() {
+	w.b.WriteByte(0xc0)
+}
+
+func (w writer) WriteBool(v bool) {
+	if v {
+		w.b.WriteByte(0xc3)
+	} else {
+		w.b.WriteByte(0xc2)
+	}
+}
+
+func (w writer) WriteInt(v int64) {
+	switch {
+	case v >= 0:
+		w.WriteUint(uint64(v))
+	case v >= -32:
+		w.b.WriteByte(byte(v)) // negative fixint
+	case v >= math.MinInt8:
+		w.byte1(0xd0, uint8(v))
+	case v >= math.MinInt16:
+		w.byte2(0xd1, uint16(v))
+	case v >= math.MinInt32:
+		w.byte4(0xd2, uint32(v))
+	default:
+		w.byte8(0xd3, uint64(v))
+	}
+}
+
+func (w writer) WriteUint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		w.b.WriteByte(byte(v)) // positive fixint
+	case v <= math.MaxUint8:
+		w.byte1(0xcc, uint8(v))
+	case v <= math.MaxUint16:
+		w.byte2(0xcd, uint16(v))
+	case v <= math.MaxUint32:
+		w.byte4(0xce, uint32(v))
+	default:
+		w.byte8(0xcf, v)
+	}
+}
+
+func (w writer) WriteFloat32(v float32) {
+	w.byte4(0xca, math.Float32bits(v))
+}
+
+func (w writer) WriteFloat64(v float64) {
+	w.byte8(0xcb, math.Float64bits(v))
+}
+
+func (w writer) WriteString(v string) {
+	switch n := len(v); {
+	case n <= 31:
+		w.b.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		w.byte1(0xd9, uint8(n))
+	case n <= math.MaxUint16:
+		w.byte2(0xda, uint16(n))
+	default:
+		w.byte4(0xdb, uint32(n))
+	}
+	w.b.WriteString(v)
+}
+
+func (w writer) WriteBytes(v []byte) {
+	switch n := len(v); {
+	case n <= math.MaxUint8:
+		w.byte1(0xc4, uint8(n))
+	case n <= math.MaxUint16:
+		w.byte2(0xc5, uint16(n))
+	default:
+		w.byte4(0xc6, uint32(n))
+	}
+	w.b.Write(v)
+}
+
+func (w writer) WriteArrayHeader(n int) {
+	switch {
+	case n <= 15:
+		w.b.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		w.byte2(0xdc, uint16(n))
+	default:
+		w.byte4(0xdd, uint32(n))
+	}
+}
+
+func (w writer) WriteMapHeader(n int) {
+	switch {
+	case n <= 15:
+		w.b.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		w.byte2(0xde, uint16(n))
+	default:
+		w.byte4(0xdf, uint32(n))
+	}
+}
+
+// reader reads MessagePack.  Extension types are rejected.
+type reader struct {
+	r *bufio.Reader
+}
+
+// uint reads an n-byte big-endian integer.
+func (r reader) uint(n int) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r.r, b[8-n:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// sizes of the lengths and values following the bytes c0 to df
+var sizes = [...]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+func (r reader) Next() (reflectcodec.Token, error) {
+	c, err := r.r.ReadByte()
+	if err != nil {
+		return reflectcodec.Token{}, err
+	}
+	switch {
+	case c <= 0x7f:
+		return reflectcodec.Token{Kind: reflectcodec.Uint, Uint: uint64(c)}, nil
+	case c <= 0x8f:
+		return reflectcodec.Token{Kind: reflectcodec.Map, Len: int(c & 0x0f)}, nil
+	case c <= 0x9f:
+		return reflectcodec.Token{Kind: reflectcodec.Array, Len: int(c & 0x0f)}, nil
+	case c <= 0xbf:
+		return r.bytes(reflectcodec.String, uint64(c&0x1f))
+	case c >= 0xe0:
+		return reflectcodec.Token{Kind: reflectcodec.Int, Int: int64(int8(c))}, nil
+	case c == 0xc0:
+		return reflectcodec.Token{Kind: reflectcodec.Nil}, nil
+	case c == 0xc2, c == 0xc3:
+		return reflectcodec.Token{Kind: reflectcodec.Bool, Bool: c == 0xc3}, nil
+	}
+
+	size := sizes[c]
+	if size == 0 {
+		return reflectcodec.Token{}, fmt.Errorf("msgpackrpc: unsupported type %#x", c)
+	}
+	v, err := r.uint(size)
+	if err != nil {
+		return reflectcodec.Token{}, err
+	}
+	switch {
+	case c <= 0xc6:
+		return r.bytes(reflectcodec.Bytes, v)
+	case c == 0xca:
+		return reflectcodec.Token{Kind: reflectcodec.Float, Float: float64(math.Float32frombits(uint32(v)))}, nil
+	case c == 0xcb:
+		return reflectcodec.Token{Kind: reflectcodec.Float, Float: math.Float64frombits(v)}, nil
+	case c <= 0xcf:
+		return reflectcodec.Token{Kind: reflectcodec.Uint, Uint: v}, nil
+	case c <= 0xd3:
+		// sign-extend
+		shift := uint(64 - 8*size)
+		return reflectcodec.Token{Kind: reflectcodec.Int, Int: int64(v<<shift) >> shift}, nil
+	case c <= 0xdb:
+		return r.bytes(reflectcodec.String, v)
+	case c <= 0xdd:
+		return reflectcodec.Token{Kind: reflectcodec.Array, Len: int(v)}, nil
+	}
+	return reflectcodec.Token{Kind: reflectcodec.Map, Len: int(v)}, nil
+}
+
+func (r reader) bytes(kind reflectcodec.Kind, n uint64) (reflectcodec.Token, error) {
+	b, err := reflectcodec.ReadBytes(r.r, n)
+	return reflectcodec.Token{Kind: kind, Bytes: b}, err
+}
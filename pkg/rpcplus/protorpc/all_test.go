@@ -0,0 +1,223 @@
+package protorpc
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// Args and Reply are encoded as protobuf messages would be:
+//
+//	message Args { int64 a = 1; int64 b = 2; }
+//	message Reply { int64 c = 1; }
+type Args struct {
+	A, B int64
+}
+
+func (a *Args) Marshal() ([]byte, error) {
+	return appendVarint(appendVarint(nil, 1, uint64(a.A)), 2, uint64(a.B)), nil
+}
+
+func (a *Args) Unmarshal(b []byte) error {
+	return unmarshalInts(b, &a.A, &a.B)
+}
+
+type Reply struct {
+	C int64
+}
+
+func (r *Reply) Marshal() ([]byte, error) {
+	return appendVarint(nil, 1, uint64(r.C)), nil
+}
+
+func (r *Reply) Unmarshal(b []byte) error {
+	return unmarshalInts(b, &r.C)
+}
+
+// unmarshalInts decodes int64 fields numbered from 1.
+func unmarshalInts(b []byte, fields ...*int64) error {
+	for _, f := range fields {
+		*f = 0
+	}
+	d := decoder{b}
+	for !d.done() {
+		field, wireType, err := d.next()
+		if err != nil {
+			return err
+		}
+		if field > len(fields) || wireType != wireVarint {
+			if err := d.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := d.varint()
+		if err != nil {
+			return err
+		}
+		*fields[field-1] = int64(v)
+	}
+	return nil
+}
+
+type Arith int
+
+func (t *Arith) Add(args *Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Div(args *Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+func (t *Arith) Checked(args *Args, reply *Reply) error {
+	return &rpc.Error{Code: -5, Message: "too large", Details: map[string]string{"max": "100"}}
+}
+
+// Count streams the numbers up to A, or forever if A is 0.
+func (t *Arith) Count(args *Args, stream rpc.Stream) error {
+	for i := int64(0); args.A == 0 || i < args.A; i++ {
+		select {
+		case stream.Send <- &Reply{C: i}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+func init() {
+	rpc.Register(new(Arith))
+}
+
+func TestHeaders(t *testing.T) {
+	// as encoded by protoc
+	b := marshalRequest(nil, &rpc.Request{ServiceMethod: "Arith.Add", Seq: 1})
+	if want := append(append([]byte{0x0a, 9}, "Arith.Add"...), 0x10, 1); !bytes.Equal(b, want) {
+		t.Errorf("request: got % x, want % x", b, want)
+	}
+
+	req := rpc.Request{
+		ServiceMethod: "Arith.Count",
+		Seq:           300,
+		Deadline:      time.Unix(1, 5),
+		Window:        64,
+		Metadata:      map[string]string{"a": "1", "": ""},
+	}
+	var got rpc.Request
+	if err := unmarshalRequest(marshalRequest(nil, &req), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ServiceMethod != req.ServiceMethod || got.Seq != req.Seq || !got.Deadline.Equal(req.Deadline) ||
+		got.Window != req.Window || !reflect.DeepEqual(got.Metadata, req.Metadata) {
+		t.Errorf("request: got %+v, want %+v", got, req)
+	}
+
+	resp := rpc.Response{
+		ServiceMethod: "Arith.Checked",
+		Seq:           2,
+		Error:         "too large",
+		ErrorCode:     -5,
+		ErrorDetails:  map[string]string{"max": "100"},
+		Metadata:      map[string]string{"k": "v"},
+	}
+	var gotResp rpc.Response
+	if err := unmarshalResponse(marshalResponse(nil, &resp, true), &gotResp); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotResp, resp) {
+		t.Errorf("response: got %+v, want %+v", gotResp, resp)
+	}
+
+	eos := rpc.Response{Seq: 3, Error: rpc.EndOfStream}
+	b = marshalResponse(nil, &eos, true)
+	if want := []byte{0x10, 3, 0x40, 1}; !bytes.Equal(b, want) {
+		t.Errorf("end of stream: got % x, want % x", b, want)
+	}
+	if err := unmarshalResponse(b, &gotResp); err != nil || gotResp.Error != rpc.EndOfStream {
+		t.Errorf("end of stream: got %+v, %v", gotResp, err)
+	}
+	if b := marshalResponse(nil, &rpc.Response{Seq: 3}, false); !bytes.Equal(b, []byte{0x10, 3, 0x38, 1}) {
+		t.Errorf("more: got % x", b)
+	}
+
+	if err := unmarshalRequest([]byte{0x0a, 5, 'a'}, &got); err == nil {
+		t.Error("expected an error for a truncated header")
+	}
+}
+
+func TestClient(t *testing.T) {
+	cli, srv := net.Pipe()
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{7, 8}, reply); err != nil || reply.C != 15 {
+		t.Errorf("Add: got %d, %v", reply.C, err)
+	}
+	err := client.Call("Arith.Div", &Args{7, 0}, reply)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "divide by zero" {
+		t.Errorf("Div: expected divide by zero ServerError; got %#v", err)
+	}
+	err = client.Call("Arith.Checked", &Args{}, reply)
+	var rpcErr *rpc.Error
+	if !errors.As(err, &rpcErr) || rpcErr.Code != -5 || rpcErr.Details["max"] != "100" {
+		t.Errorf("Checked: unexpected error %#v", err)
+	}
+	if err := client.Call("Arith.Add", struct{ A, B int }{1, 2}, reply); err == nil {
+		t.Error("expected an error for an argument that is not a Message")
+	}
+}
+
+func TestStream(t *testing.T) {
+	cli, srv := net.Pipe()
+	go ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	rows := make(chan *Reply)
+	c := client.StreamGo("Arith.Count", &Args{A: 5}, rows)
+	count := int64(0)
+	for row := range rows {
+		if row.C != count {
+			t.Fatal("unexpected value:", row.C)
+		}
+		count++
+	}
+	if c.Error != nil || count != 5 {
+		t.Fatalf("Count: got %d values and error %v", count, c.Error)
+	}
+
+	// an endless stream stops once closed by the client
+	rows = make(chan *Reply)
+	c = client.StreamGo("Arith.Count", &Args{}, rows)
+	<-rows
+	if err := c.CloseStream(); err != nil {
+		t.Fatal("CloseStream:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for range rows {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not stopped")
+	}
+	if c.Error != nil {
+		t.Error("unexpected error:", c.Error)
+	}
+}
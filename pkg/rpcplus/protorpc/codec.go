@@ -0,0 +1,224 @@
+// Package protorpc implements a Protocol Buffers ClientCodec and
+// ServerCodec for the rpc package, so that services can be called from
+// other languages.
+//
+// Every request and response is a header message followed by a body, each
+// prefixed with its length as a varint, as with protobuf's delimited
+// streams.  The headers are the RequestHeader and ResponseHeader messages
+// of rpc.proto, and the bodies are the encoded arguments and replies, which
+// must implement Message.  Requests controlling a call in progress, such
+// as the CloseStream request stopping it, are described there too.
+package protorpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// MediaType is the media type the codec is registered under with
+// rpc.RegisterCodec.
+const MediaType = "application/vnd.flynn.rpc-hijack+protobuf"
+
+func init() {
+	rpc.RegisterCodec(MediaType, rpc.Codec{
+		NewClientCodec: NewClientCodec,
+		NewServerCodec: NewServerCodec,
+	})
+}
+
+// Message is implemented by the arguments and replies of the methods
+// called with this codec, such as the types generated by protoc-gen-gogo.
+type Message interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// MaxFrameSize is the size of the largest header or body accepted.
+const MaxFrameSize = 64 << 20
+
+var errFrameTooLarge = errors.New("protorpc: frame too large")
+
+// readFrame reads a length-prefixed frame.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeFrame(w *bufio.Writer, b []byte) error {
+	var n [binary.MaxVarintLen64]byte
+	if _, err := w.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// marshalBody encodes a body.  Control requests and invalid requests carry
+// an empty struct, sent as an empty body.
+func marshalBody(x interface{}) ([]byte, error) {
+	switch x := x.(type) {
+	case nil, struct{}:
+		return nil, nil
+	case Message:
+		return x.Marshal()
+	}
+	return nil, fmt.Errorf("protorpc: %T does not implement Message", x)
+}
+
+func unmarshalBody(b []byte, x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	m, ok := x.(Message)
+	if !ok {
+		return fmt.Errorf("protorpc: %T does not implement Message", x)
+	}
+	return m.Unmarshal(b)
+}
+
+type serverCodec struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	c   io.Closer
+	hdr []byte // for encoding headers
+}
+
+// NewServerCodec returns a new rpc.ServerCodec using Protocol Buffers on
+// conn.
+func NewServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &serverCodec{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), c: conn}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	b, err := readFrame(c.r)
+	if err != nil {
+		return err
+	}
+	return unmarshalRequest(b, r)
+}
+
+func (c *serverCodec) ReadRequestBody(x interface{}) error {
+	b, err := readFrame(c.r)
+	if err != nil {
+		return err
+	}
+	return unmarshalBody(b, x)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, x interface{}, last bool) error {
+	body, err := marshalBody(x)
+	if err != nil {
+		// the client still expects the response
+		r.Error = err.Error()
+		r.ErrorCode = rpc.CodeInternal
+		body = nil
+	}
+	c.hdr = marshalResponse(c.hdr[:0], r, last)
+	if err := writeFrame(c.w, c.hdr); err != nil {
+		return err
+	}
+	if err := writeFrame(c.w, body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	return c.c.Close()
+}
+
+type clientCodec struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	c   io.Closer
+	hdr []byte // for encoding headers
+}
+
+// NewClientCodec returns a new rpc.ClientCodec using Protocol Buffers on
+// conn.
+func NewClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &clientCodec{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), c: conn}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, x interface{}) error {
+	body, err := marshalBody(x)
+	if err != nil {
+		return err
+	}
+	c.hdr = marshalRequest(c.hdr[:0], r)
+	if err := writeFrame(c.w, c.hdr); err != nil {
+		return err
+	}
+	if err := writeFrame(c.w, body); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	b, err := readFrame(c.r)
+	if err != nil {
+		return err
+	}
+	return unmarshalResponse(b, r)
+}
+
+func (c *clientCodec) ReadResponseBody(x interface{}) error {
+	b, err := readFrame(c.r)
+	if err != nil {
+		return err
+	}
+	return unmarshalBody(b, x)
+}
+
+func (c *clientCodec) Close() error {
+	return c.c.Close()
+}
+
+// NewClient returns a new rpc.Client to handle requests to the
+// set of services at the other end of the connection.
+func NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(NewClientCodec(conn))
+}
+
+// Dial connects to a Protocol Buffers RPC server at the specified network
+// address.
+func Dial(network, address string) (*rpc.Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), err
+}
+
+// ServeConn runs the Protocol Buffers server on a single connection.
+// ServeConn blocks, serving the connection until the client hangs up.
+// The caller typically invokes ServeConn in a go statement.
+func ServeConn(conn io.ReadWriteCloser) {
+	rpc.ServeCodec(NewServerCodec(conn))
+}
+
+// ServeConnWithContext is like ServeConn but it allows to pass a
+// connection context to the RPC methods.
+func ServeConnWithContext(conn io.ReadWriteCloser, context interface{}) {
+	rpc.ServeCodecWithContext(NewServerCodec(conn), context)
+}
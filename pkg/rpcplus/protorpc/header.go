@@ -0,0 +1,152 @@
+package protorpc
+
+import (
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+// Field numbers of RequestHeader, see rpc.proto.
+const (
+	reqServiceMethod = 1
+	reqSeq           = 2
+	reqDeadline      = 3
+	reqWindow        = 4
+	reqMetadata      = 5
+)
+
+// Field numbers of ResponseHeader, see rpc.proto.
+const (
+	respServiceMethod = 1
+	respSeq           = 2
+	respError         = 3
+	respErrorCode     = 4
+	respErrorDetails  = 5
+	respMetadata      = 6
+	respMore          = 7
+	respEOS           = 8
+)
+
+func marshalRequest(b []byte, r *rpc.Request) []byte {
+	b = appendString(b, reqServiceMethod, r.ServiceMethod)
+	b = appendVarint(b, reqSeq, r.Seq)
+	if !r.Deadline.IsZero() {
+		b = appendVarint(b, reqDeadline, uint64(r.Deadline.UnixNano()))
+	}
+	b = appendVarint(b, reqWindow, uint64(r.Window))
+	return appendMap(b, reqMetadata, r.Metadata)
+}
+
+func unmarshalRequest(b []byte, r *rpc.Request) error {
+	r.ServiceMethod = ""
+	r.Seq = 0
+	r.Deadline = time.Time{}
+	r.Window = 0
+	r.Metadata = nil
+	d := decoder{b}
+	for !d.done() {
+		field, wireType, err := d.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == reqServiceMethod && wireType == wireBytes:
+			var s []byte
+			s, err = d.bytes()
+			r.ServiceMethod = string(s)
+		case field == reqSeq && wireType == wireVarint:
+			r.Seq, err = d.varint()
+		case field == reqDeadline && wireType == wireVarint:
+			var v uint64
+			if v, err = d.varint(); v != 0 {
+				r.Deadline = time.Unix(0, int64(v))
+			}
+		case field == reqWindow && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			r.Window = uint32(v)
+		case field == reqMetadata && wireType == wireBytes:
+			if r.Metadata == nil {
+				r.Metadata = make(map[string]string)
+			}
+			err = d.mapEntry(r.Metadata)
+		default:
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// marshalResponse encodes the header of a response, the end of a stream
+// being marked by eos rather than rpc.EndOfStream.
+func marshalResponse(b []byte, r *rpc.Response, last bool) []byte {
+	b = appendString(b, respServiceMethod, r.ServiceMethod)
+	b = appendVarint(b, respSeq, r.Seq)
+	if r.Error == rpc.EndOfStream {
+		b = appendBool(b, respEOS, true)
+	} else {
+		b = appendString(b, respError, r.Error)
+		// int32, sign-extended as protobuf does
+		b = appendVarint(b, respErrorCode, uint64(int64(int32(r.ErrorCode))))
+		b = appendMap(b, respErrorDetails, r.ErrorDetails)
+	}
+	b = appendMap(b, respMetadata, r.Metadata)
+	return appendBool(b, respMore, !last)
+}
+
+func unmarshalResponse(b []byte, r *rpc.Response) error {
+	r.ServiceMethod = ""
+	r.Seq = 0
+	r.Error = ""
+	r.ErrorCode = rpc.CodeUnknown
+	r.ErrorDetails = nil
+	r.Metadata = nil
+	d := decoder{b}
+	for !d.done() {
+		field, wireType, err := d.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == respServiceMethod && wireType == wireBytes:
+			var s []byte
+			s, err = d.bytes()
+			r.ServiceMethod = string(s)
+		case field == respSeq && wireType == wireVarint:
+			r.Seq, err = d.varint()
+		case field == respError && wireType == wireBytes:
+			var s []byte
+			s, err = d.bytes()
+			r.Error = string(s)
+		case field == respErrorCode && wireType == wireVarint:
+			var v uint64
+			v, err = d.varint()
+			r.ErrorCode = rpc.ErrorCode(int32(v))
+		case field == respErrorDetails && wireType == wireBytes:
+			if r.ErrorDetails == nil {
+				r.ErrorDetails = make(map[string]string)
+			}
+			err = d.mapEntry(r.ErrorDetails)
+		case field == respMetadata && wireType == wireBytes:
+			if r.Metadata == nil {
+				r.Metadata = make(map[string]string)
+			}
+			err = d.mapEntry(r.Metadata)
+		case field == respEOS && wireType == wireVarint:
+			var v uint64
+			if v, err = d.varint(); v != 0 {
+				r.Error = rpc.EndOfStream
+			}
+		default:
+			// including more, which package rpc does not need
+			err = d.skip(wireType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package protorpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protorpc: truncated message")
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// appendVarint appends a varint field, unless it has the default value.
+func appendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, field, 1)
+}
+
+// appendBytes appends a length-delimited field, even if it is empty.
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendString appends a string field, unless it is empty.
+func appendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendMap appends a map<string, string> field: an entry message per key,
+// with the key as field 1 and the value as field 2.  Keys are sorted so
+// that the encoding is deterministic.
+func appendMap(b []byte, field int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var entry []byte
+	for _, k := range keys {
+		entry = appendString(appendString(entry[:0], 1, k), 2, m[k])
+		b = appendBytes(b, field, entry)
+	}
+	return b
+}
+
+// decoder reads the fields of a message.
+type decoder struct {
+	b []byte
+}
+
+func (d *decoder) done() bool {
+	return len(d.b) == 0
+}
+
+// next returns the number and wire type of the next field.
+func (d *decoder) next() (int, int, error) {
+	tag, err := d.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if tag>>3 == 0 {
+		return 0, 0, errors.New("protorpc: invalid field number 0")
+	}
+	return int(tag >> 3), int(tag & 7), nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.b)) {
+		return nil, errTruncated
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// skip skips the value of a field of an unknown number.
+func (d *decoder) skip(wireType int) error {
+	var n int
+	switch wireType {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case wireFixed64:
+		n = 8
+	case wireFixed32:
+		n = 4
+	default:
+		return errors.New("protorpc: unsupported wire type")
+	}
+	if len(d.b) < n {
+		return errTruncated
+	}
+	d.b = d.b[n:]
+	return nil
+}
+
+// mapEntry decodes an entry of a map<string, string> field into m.
+func (d *decoder) mapEntry(m map[string]string) error {
+	b, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	entry := decoder{b}
+	var k, v string
+	for !entry.done() {
+		field, wireType, err := entry.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == wireBytes:
+			b, err := entry.bytes()
+			if err != nil {
+				return err
+			}
+			k = string(b)
+		case field == 2 && wireType == wireBytes:
+			b, err := entry.bytes()
+			if err != nil {
+				return err
+			}
+			v = string(b)
+		default:
+			if err := entry.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	m[k] = v
+	return nil
+}
@@ -0,0 +1,304 @@
+package rpcplus
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ClientDialFunc connects to a server, for instance by calling Dial or
+// DialHTTPPath.
+type ClientDialFunc func() (*Client, error)
+
+// ConnState is the state of the connection of a ReconnectingClient.
+type ConnState int
+
+const (
+	StateConnecting   ConnState = iota // dialing the server
+	StateConnected                     // calls are sent to the server
+	StateDisconnected                  // waiting to dial again
+	StateClosed                        // Close has been called
+)
+
+var connStateNames = []string{"connecting", "connected", "disconnected", "closed"}
+
+func (s ConnState) String() string {
+	if s < 0 || int(s) >= len(connStateNames) {
+		return "unknown"
+	}
+	return connStateNames[s]
+}
+
+// ReconnectPolicy configures a ReconnectingClient.  The zero value is
+// usable: dialing is retried after 100ms, doubling up to 30s with 20%
+// jitter, and calls interrupted by a lost connection fail.
+type ReconnectPolicy struct {
+	InitialBackoff time.Duration // delay before dialing again after a failure
+	MaxBackoff     time.Duration // limit of the delay as it grows
+	Multiplier     float64       // growth of the delay after each failure
+	Jitter         float64       // random fraction added to or removed from the delay
+
+	// RetryPending sends the calls that were in flight when the
+	// connection was lost again once it is back.  Only set it if the
+	// methods are safe to run twice.  Calls that were never sent are
+	// always retried.
+	RetryPending bool
+
+	// FailFast makes calls fail with ErrShutdown while disconnected
+	// rather than wait for the connection to come back.
+	FailFast bool
+
+	// OnStateChange, if set, is called with each new state of the
+	// connection.  It must not block.
+	OnStateChange func(ConnState)
+}
+
+func (p *ReconnectPolicy) setDefaults() {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter <= 0 || p.Jitter > 1 {
+		p.Jitter = 0.2
+	}
+}
+
+// backoff returns the delay before the next attempt to dial, d jittered.
+func (p *ReconnectPolicy) backoff(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// ReconnectingClient is a client that dials the server again, with
+// exponential backoff, whenever the connection is lost or the server
+// shuts it down.  It may be used by multiple goroutines simultaneously.
+//
+// The retry policy applies to the unary calls made with Call, CallContext,
+// Go and GoContext.  Streams are started on the Client of the current
+// connection, returned by Client, and fail with it: as their replies may
+// have been received already, they are not sent again.
+type ReconnectingClient struct {
+	dial   ClientDialFunc
+	policy ReconnectPolicy
+
+	mu        sync.Mutex // protects client, state, connected
+	client    *Client    // nil unless connected
+	state     ConnState
+	connected chan struct{} // closed once client is set
+	dropped   chan struct{} // signals run that client was dropped
+	quit      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// NewReconnectingClient returns a client connected with dial, which it
+// starts dialing right away.
+func NewReconnectingClient(dial ClientDialFunc, policy ReconnectPolicy) *ReconnectingClient {
+	policy.setDefaults()
+	rc := &ReconnectingClient{
+		dial:      dial,
+		policy:    policy,
+		state:     StateConnecting,
+		connected: make(chan struct{}),
+		dropped:   make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+	go rc.run()
+	return rc
+}
+
+// setState records the new state of the connection and reports it.
+func (rc *ReconnectingClient) setState(state ConnState) {
+	rc.mu.Lock()
+	changed := rc.state != state && rc.state != StateClosed
+	if changed {
+		rc.state = state
+	}
+	rc.mu.Unlock()
+	if changed && rc.policy.OnStateChange != nil {
+		rc.policy.OnStateChange(state)
+	}
+}
+
+// run dials the server and waits for the connection to be lost, until
+// the client is closed.
+func (rc *ReconnectingClient) run() {
+	backoff := rc.policy.InitialBackoff
+	for {
+		rc.setState(StateConnecting)
+		client, err := rc.dial()
+		if err != nil {
+			rc.setState(StateDisconnected)
+			select {
+			case <-time.After(rc.policy.backoff(backoff)):
+			case <-rc.quit:
+				return
+			}
+			backoff = time.Duration(float64(backoff) * rc.policy.Multiplier)
+			if backoff > rc.policy.MaxBackoff {
+				backoff = rc.policy.MaxBackoff
+			}
+			continue
+		}
+		backoff = rc.policy.InitialBackoff
+
+		rc.mu.Lock()
+		rc.client = client
+		close(rc.connected)
+		rc.mu.Unlock()
+		rc.setState(StateConnected)
+
+		for lost := false; !lost; {
+			select {
+			case <-client.CloseNotify():
+				rc.drop(client)
+				lost = true
+			case <-rc.dropped:
+				// the server is draining the connection: the
+				// calls in flight complete on it, new ones go
+				// to the next connection.
+				rc.mu.Lock()
+				lost = rc.client != client
+				rc.mu.Unlock()
+			case <-rc.quit:
+				client.Close()
+				return
+			}
+		}
+		rc.setState(StateDisconnected)
+	}
+}
+
+// Client returns the client of the current connection, waiting for it to
+// be established unless the policy is to fail fast.
+func (rc *ReconnectingClient) Client(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.Lock()
+		client, state, connected := rc.client, rc.state, rc.connected
+		rc.mu.Unlock()
+		if state == StateClosed {
+			return nil, ErrShutdown
+		}
+		if client != nil {
+			return client, nil
+		}
+		if rc.policy.FailFast {
+			return nil, ErrShutdown
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rc.quit:
+			return nil, ErrShutdown
+		}
+	}
+}
+
+// State returns the current state of the connection.
+func (rc *ReconnectingClient) State() ConnState {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.state
+}
+
+// Call invokes the named function, waits for it to complete, and returns
+// its error status.  See CallContext.
+func (rc *ReconnectingClient) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	return rc.CallContext(context.Background(), serviceMethod, args, reply)
+}
+
+// CallContext invokes the named function on the current connection, waiting
+// for one as needed.  If the connection is lost during the call, it is sent
+// again on the next connection if the policy is to retry pending calls,
+// and fails otherwise.
+func (rc *ReconnectingClient) CallContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}) error {
+	for {
+		client, err := rc.Client(ctx)
+		if err != nil {
+			return err
+		}
+		err = client.CallContext(ctx, serviceMethod, args, reply)
+		if err == nil || !rc.lost(client, err) {
+			return err
+		}
+		if err != ErrShutdown && !rc.policy.RetryPending {
+			return err
+		}
+	}
+}
+
+// Go invokes the named function asynchronously, as CallContext does with
+// context.Background().  The done channel signals completion as with
+// Client.Go.
+func (rc *ReconnectingClient) Go(serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	return rc.GoContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+// GoContext invokes the named function asynchronously, as CallContext
+// does.  The done channel signals completion as with Client.Go.
+func (rc *ReconnectingClient) GoContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
+	call := newCall(serviceMethod, args, reply, done)
+	go func() {
+		call.Error = rc.CallContext(ctx, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// lost reports whether a call on client failed with err because the
+// connection was lost or is being drained, in which case a new connection
+// is dialed.
+func (rc *ReconnectingClient) lost(client *Client, err error) bool {
+	var serverErr ServerError
+	var rpcErr *Error
+	if errors.As(err, &serverErr) || errors.As(err, &rpcErr) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	select {
+	case <-client.CloseNotify():
+	default:
+		if err != ErrShutdown {
+			return false
+		}
+		// the server is draining the connection
+	}
+	rc.drop(client)
+	return true
+}
+
+// drop stops sending calls on client, if it is still the current one, and
+// has run dial a new connection.
+func (rc *ReconnectingClient) drop(client *Client) {
+	rc.mu.Lock()
+	if rc.client == client {
+		rc.client = nil
+		rc.connected = make(chan struct{})
+	}
+	rc.mu.Unlock()
+	select {
+	case rc.dropped <- struct{}{}:
+	default:
+	}
+}
+
+// Close closes the current connection and stops dialing.  Calls waiting
+// for a connection fail with ErrShutdown.
+func (rc *ReconnectingClient) Close() error {
+	err := ErrShutdown
+	rc.closeOnce.Do(func() {
+		rc.setState(StateClosed)
+		close(rc.quit)
+		err = nil
+	})
+	return err
+}
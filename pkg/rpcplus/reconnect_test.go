@@ -0,0 +1,172 @@
+package rpcplus
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startReconnectServer starts a server whose connections are sent on the
+// returned channel, so that tests can break them.
+func startReconnectServer(t *testing.T) (*Drainer, string, chan net.Conn) {
+	d := &Drainer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	server := NewServer()
+	if err := server.Register(d); err != nil {
+		t.Fatal("Register failed", err)
+	}
+	server.Register(new(Arith))
+	l, addr := listenTCP()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go server.ServeConn(conn)
+		}
+	}()
+	return d, addr, conns
+}
+
+func TestReconnect(t *testing.T) {
+	d, addr, conns := startReconnectServer(t)
+	defer close(d.release)
+
+	var attempts int32
+	dial := func() (*Client, error) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			return nil, errors.New("connection refused")
+		}
+		return Dial("tcp", addr)
+	}
+	states := make(chan ConnState, 100)
+	rc := NewReconnectingClient(dial, ReconnectPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		OnStateChange:  func(s ConnState) { states <- s },
+	})
+	defer rc.Close()
+
+	reply := new(Reply)
+	if err := rc.Call("Arith.Add", &Args{3, 4}, reply); err != nil {
+		t.Fatal("Add:", err)
+	}
+	if reply.C != 7 {
+		t.Errorf("Add: expected 7 got %d", reply.C)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("expected 3 attempts to dial, got %d", n)
+	}
+
+	// a call in flight fails when the connection is lost
+	errc := make(chan error)
+	go func() { errc <- rc.Call("Drainer.Wait", &Args{7, 8}, new(Reply)) }()
+	<-d.started
+	(<-conns).Close()
+	if err := <-errc; err == nil {
+		t.Error("Wait: expected an error from the lost connection")
+	}
+
+	reply = new(Reply)
+	if err := rc.Call("Arith.Add", &Args{5, 6}, reply); err != nil {
+		t.Fatal("Add after reconnecting:", err)
+	}
+	if reply.C != 11 {
+		t.Errorf("Add: expected 11 got %d", reply.C)
+	}
+
+	rc.Close()
+	if err := rc.Call("Arith.Add", &Args{5, 6}, new(Reply)); err != ErrShutdown {
+		t.Errorf("expected ErrShutdown after Close, got %v", err)
+	}
+
+	expected := []ConnState{
+		StateDisconnected, StateConnecting, StateDisconnected, StateConnecting, StateConnected,
+		StateDisconnected, StateConnecting, StateConnected,
+		StateClosed,
+	}
+	for i, want := range expected {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("state %d: expected %s got %s", i, want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("state %d: expected %s, got nothing", i, want)
+		}
+	}
+}
+
+func TestReconnectRetryPending(t *testing.T) {
+	d, addr, conns := startReconnectServer(t)
+	rc := NewReconnectingClient(func() (*Client, error) {
+		return Dial("tcp", addr)
+	}, ReconnectPolicy{InitialBackoff: 10 * time.Millisecond, RetryPending: true})
+	defer rc.Close()
+
+	reply := new(Reply)
+	errc := make(chan error)
+	go func() { errc <- rc.Call("Drainer.Wait", &Args{7, 8}, reply) }()
+	<-d.started
+	(<-conns).Close()
+
+	// the call is sent again on the next connection
+	select {
+	case <-d.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call was not retried")
+	}
+	close(d.release)
+	if err := <-errc; err != nil {
+		t.Fatal("Wait:", err)
+	}
+	if reply.C != 15 {
+		t.Errorf("Wait: expected 15 got %d", reply.C)
+	}
+}
+
+func TestReconnectGo(t *testing.T) {
+	d, addr, conns := startReconnectServer(t)
+	rc := NewReconnectingClient(func() (*Client, error) {
+		return Dial("tcp", addr)
+	}, ReconnectPolicy{InitialBackoff: 10 * time.Millisecond, RetryPending: true})
+	defer rc.Close()
+
+	// asynchronous calls follow the policy too
+	reply := new(Reply)
+	call := rc.Go("Drainer.Wait", &Args{7, 8}, reply, nil)
+	<-d.started
+	(<-conns).Close()
+	select {
+	case <-d.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call was not retried")
+	}
+	close(d.release)
+	<-call.Done
+	if call.Error != nil {
+		t.Fatal("Wait:", call.Error)
+	}
+	if reply.C != 15 {
+		t.Errorf("Wait: expected 15 got %d", reply.C)
+	}
+}
+
+func TestReconnectFailFast(t *testing.T) {
+	rc := NewReconnectingClient(func() (*Client, error) {
+		return nil, errors.New("connection refused")
+	}, ReconnectPolicy{InitialBackoff: time.Hour, FailFast: true})
+
+	if err := rc.Call("Arith.Add", &Args{1, 2}, new(Reply)); err != ErrShutdown {
+		t.Errorf("expected ErrShutdown while disconnected, got %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+	if state := rc.State(); state != StateClosed {
+		t.Errorf("expected state %s got %s", StateClosed, state)
+	}
+}
@@ -0,0 +1,550 @@
+// Package rpctest checks that a codec of package rpcplus carries everything
+// the gob codec does: arguments and replies of the common Go types, errors
+// with their codes and details, metadata, deadlines, and streams in either
+// direction with their cancellation and flow control.
+//
+// A codec package runs the suite from its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		rpctest.TestCodec(t, rpc.Codec{NewClientCodec: NewClientCodec, NewServerCodec: NewServerCodec})
+//	}
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rpc "github.com/shutej/flynn/pkg/rpcplus"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	C int
+}
+
+// Values has a field of each kind of value a codec must carry.
+type Values struct {
+	Int    int64
+	Uint   uint64
+	Float  float64
+	Bool   bool
+	String string
+	Bytes  []byte
+	Slice  []string
+	Map    map[string]int
+	Ptr    *Reply
+	Time   time.Time
+}
+
+type Arith int
+
+// Some of Arith's methods have value args, some have pointer args. That's deliberate.
+
+func (t *Arith) Add(args Args, reply *Reply) error {
+	reply.C = args.A + args.B
+	return nil
+}
+
+func (t *Arith) Mul(args *Args, reply *Reply) error {
+	reply.C = args.A * args.B
+	return nil
+}
+
+func (t *Arith) Div(args Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("divide by zero")
+	}
+	reply.C = args.A / args.B
+	return nil
+}
+
+func (t *Arith) String(args *Args, reply *string) error {
+	*reply = fmt.Sprintf("%d+%d=%d", args.A, args.B, args.A+args.B)
+	return nil
+}
+
+func (t *Arith) Scan(args string, reply *Reply) (err error) {
+	_, err = fmt.Sscan(args, &reply.C)
+	return
+}
+
+func (t *Arith) Error(args *Args, reply *Reply) error {
+	panic("ERROR")
+}
+
+const CodeTooLarge rpc.ErrorCode = 1000
+
+func (t *Arith) Checked(args Args, reply *Reply) error {
+	if args.A > 100 {
+		err := &rpc.Error{Code: CodeTooLarge, Message: "too large", Details: map[string]string{"max": "100"}}
+		return fmt.Errorf("Checked: %w", err)
+	}
+	reply.C = args.A
+	return nil
+}
+
+func (t *Arith) Identity(args Values, reply *Values) error {
+	*reply = args
+	return nil
+}
+
+// Deadline replies with the deadline of the call in nanoseconds since the
+// Unix epoch, 0 if it has none.
+func (t *Arith) Deadline(ctx context.Context, args Args, reply *int64) error {
+	if d, ok := ctx.Deadline(); ok {
+		*reply = d.UnixNano()
+	}
+	return nil
+}
+
+func (t *Arith) Metadata(ctx context.Context, args Args, reply *string) error {
+	md := rpc.MetadataFromContext(ctx)
+	*reply = md["token"]
+	rpc.SetResponseMetadata(ctx, "trace", md["trace"]+"-done")
+	return nil
+}
+
+type StreamingArgs struct {
+	A       int
+	Count   int
+	ErrorAt int // will trigger an error at the given spot, if between 0 and Count-1
+}
+
+type StreamingReply struct {
+	C     int
+	Index int
+}
+
+type StreamingArith struct {
+	sent int32 // values sent by Counted
+}
+
+func (t *StreamingArith) Thrive(args StreamingArgs, stream rpc.Stream) error {
+	for i := 0; i < args.Count; i++ {
+		if i == args.ErrorAt {
+			return errors.New("Triggered error in middle")
+		}
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (t *StreamingArith) Forever(args StreamingArgs, stream rpc.Stream) error {
+	for i := 0; ; i++ {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
+
+func (t *StreamingArith) Panic(args StreamingArgs, stream rpc.Stream) error {
+	for i := 0; i < args.Count; i++ {
+		stream.Send <- &StreamingReply{C: args.A, Index: i}
+	}
+	panic("stream panic")
+}
+
+func (t *StreamingArith) Sum(in <-chan *StreamingArgs, reply *StreamingReply) error {
+	for args := range in {
+		reply.C += args.A
+		reply.Index++
+	}
+	return nil
+}
+
+func (t *StreamingArith) Echo(in <-chan *StreamingArgs, stream rpc.Stream) error {
+	i := 0
+	for args := range in {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+		case <-stream.Error:
+			return nil
+		}
+		i++
+	}
+	return nil
+}
+
+func (t *StreamingArith) Counted(args StreamingArgs, stream rpc.Stream) error {
+	for i := 0; i < args.Count; i++ {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+			atomic.AddInt32(&t.sent, 1)
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
+// link is a client connected to a server of its own with the codec.
+type link struct {
+	client    *rpc.Client
+	streaming *StreamingArith
+}
+
+func newLink(t *testing.T, codec rpc.Codec) *link {
+	l := &link{streaming: new(StreamingArith)}
+	server := rpc.NewServer()
+	if err := server.Register(new(Arith)); err != nil {
+		t.Fatal("Register failed", err)
+	}
+	if err := server.Register(l.streaming); err != nil {
+		t.Fatal("Register failed", err)
+	}
+	cli, srv := net.Pipe()
+	go server.ServeCodec(codec.NewServerCodec(srv))
+	l.client = rpc.NewClientWithCodec(codec.NewClientCodec(cli))
+	t.Cleanup(func() { l.client.Close() })
+	return l
+}
+
+// TestCodec runs the conformance suite against codec, each test on a
+// connection of its own.
+func TestCodec(t *testing.T, codec rpc.Codec) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, *link)
+	}{
+		{"Call", testCall},
+		{"Values", testValues},
+		{"Errors", testErrors},
+		{"Metadata", testMetadata},
+		{"Deadline", testDeadline},
+		{"Stream", testStream},
+		{"StreamError", testStreamError},
+		{"CloseStream", testCloseStream},
+		{"StreamPanic", testStreamPanic},
+		{"ClientStream", testClientStream},
+		{"BidiStream", testBidiStream},
+		{"FlowControl", testFlowControl},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newLink(t, codec))
+		})
+	}
+}
+
+func testCall(t *testing.T, l *link) {
+	args := &Args{7, 8}
+	reply := new(Reply)
+	if err := l.client.Call("Arith.Add", args, reply); err != nil {
+		t.Errorf("Add: expected no error but got string %q", err.Error())
+	} else if reply.C != args.A+args.B {
+		t.Errorf("Add: expected %d got %d", args.A+args.B, reply.C)
+	}
+
+	// Out of order.
+	mulReply := new(Reply)
+	mulCall := l.client.Go("Arith.Mul", args, mulReply, nil)
+	addReply := new(Reply)
+	addCall := l.client.Go("Arith.Add", args, addReply, nil)
+	if addCall = <-addCall.Done; addCall.Error != nil {
+		t.Errorf("Add: expected no error but got string %q", addCall.Error.Error())
+	} else if addReply.C != args.A+args.B {
+		t.Errorf("Add: expected %d got %d", args.A+args.B, addReply.C)
+	}
+	if mulCall = <-mulCall.Done; mulCall.Error != nil {
+		t.Errorf("Mul: expected no error but got string %q", mulCall.Error.Error())
+	} else if mulReply.C != args.A*args.B {
+		t.Errorf("Mul: expected %d got %d", args.A*args.B, mulReply.C)
+	}
+
+	// Non-struct argument
+	const Val = 12345
+	str := fmt.Sprint(Val)
+	reply = new(Reply)
+	if err := l.client.Call("Arith.Scan", &str, reply); err != nil {
+		t.Errorf("Scan: expected no error but got string %q", err.Error())
+	} else if reply.C != Val {
+		t.Errorf("Scan: expected %d got %d", Val, reply.C)
+	}
+
+	// Non-struct reply
+	args = &Args{27, 35}
+	str = ""
+	if err := l.client.Call("Arith.String", args, &str); err != nil {
+		t.Errorf("String: expected no error but got string %q", err.Error())
+	} else if expect := fmt.Sprintf("%d+%d=%d", args.A, args.B, args.A+args.B); str != expect {
+		t.Errorf("String: expected %s got %s", expect, str)
+	}
+}
+
+func testValues(t *testing.T, l *link) {
+	args := Values{
+		Int:    -1 << 40,
+		Uint:   1<<64 - 1,
+		Float:  3.25,
+		Bool:   true,
+		String: "héllo",
+		Bytes:  []byte{0, 1, 0xff},
+		Slice:  []string{"a", "b"},
+		Map:    map[string]int{"x": 1, "y": -2},
+		Ptr:    &Reply{C: 42},
+		Time:   time.Unix(1234567890, 123456789).UTC(),
+	}
+	var reply Values
+	if err := l.client.Call("Arith.Identity", args, &reply); err != nil {
+		t.Fatal("Identity:", err)
+	}
+	if !reply.Time.Equal(args.Time) {
+		t.Errorf("Identity: expected time %v got %v", args.Time, reply.Time)
+	}
+	args.Time, reply.Time = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(reply, args) {
+		t.Errorf("Identity: expected %+v got %+v", args, reply)
+	}
+}
+
+func testErrors(t *testing.T, l *link) {
+	reply := new(Reply)
+
+	err := l.client.Call("Arith.Div", &Args{7, 0}, reply)
+	if err == nil {
+		t.Error("Div: expected error")
+	} else if err.Error() != "divide by zero" {
+		t.Error("Div: expected divide by zero error; got", err)
+	} else if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("Div: expected ServerError; got %#v", err)
+	}
+
+	err = l.client.Call("Arith.BadOperation", &Args{7, 0}, reply)
+	if !errors.Is(err, rpc.ErrUnknownMethod) {
+		t.Errorf("BadOperation: expected ErrUnknownMethod; got %#v", err)
+	}
+	err = l.client.Call("Unknown.Add", &Args{7, 0}, reply)
+	if !errors.Is(err, rpc.ErrUnknownService) {
+		t.Errorf("expected ErrUnknownService; got %#v", err)
+	}
+
+	err = l.client.Call("Arith.Checked", &Args{A: 1000}, reply)
+	var rpcErr *rpc.Error
+	if !errors.As(err, &rpcErr) {
+		t.Errorf("Checked: expected *Error; got %#v", err)
+	} else if rpcErr.Code != CodeTooLarge || rpcErr.Message != "Checked: too large" || rpcErr.Details["max"] != "100" {
+		t.Errorf("Checked: unexpected error %#v", rpcErr)
+	}
+
+	err = l.client.Call("Arith.Error", &Args{}, reply)
+	if !errors.Is(err, rpc.ErrInternal) || !strings.Contains(err.Error(), "ERROR") {
+		t.Errorf("Error: expected ErrInternal with the panic; got %#v", err)
+	}
+
+	err = l.client.Call("Arith.Add", "not args", reply)
+	if !errors.Is(err, rpc.ErrBadArgument) {
+		t.Errorf("expected ErrBadArgument; got %#v", err)
+	}
+
+	// the connection survives the errors
+	if err := l.client.Call("Arith.Add", &Args{1, 2}, reply); err != nil || reply.C != 3 {
+		t.Errorf("Add: expected 3 got %d, %v", reply.C, err)
+	}
+}
+
+func testMetadata(t *testing.T, l *link) {
+	ctx := rpc.WithMetadata(context.Background(), map[string]string{"token": "secret", "trace": "abc"})
+	var reply string
+	call := <-l.client.GoContext(ctx, "Arith.Metadata", &Args{}, &reply, nil).Done
+	if call.Error != nil {
+		t.Fatal("Metadata:", call.Error)
+	}
+	if reply != "secret" {
+		t.Errorf("Metadata: expected token %q got %q", "secret", reply)
+	}
+	if trace := call.ResponseMetadata["trace"]; trace != "abc-done" {
+		t.Errorf("Metadata: expected trace %q got %q", "abc-done", trace)
+	}
+}
+
+func testDeadline(t *testing.T, l *link) {
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	var reply int64
+	if err := l.client.CallContext(ctx, "Arith.Deadline", &Args{}, &reply); err != nil {
+		t.Fatal("Deadline:", err)
+	}
+	if reply != deadline.UnixNano() {
+		t.Errorf("Deadline: expected %d got %d", deadline.UnixNano(), reply)
+	}
+	if err := l.client.Call("Arith.Deadline", &Args{}, &reply); err != nil || reply != 0 {
+		t.Errorf("Deadline: expected none, got %d, %v", reply, err)
+	}
+}
+
+// stream checks that a Thrive stream of count values is received in order
+// and ends with the error errText, or successfully if it is empty.
+func stream(t *testing.T, l *link, method string, count int, errText string) {
+	rowChan := make(chan *StreamingReply, 10)
+	c := l.client.StreamGo(method, &StreamingArgs{3, count, -1}, rowChan)
+	n := 0
+	for row := range rowChan {
+		if row.C != 3 || row.Index != n {
+			t.Fatalf("%s: unexpected value %+v", method, row)
+		}
+		n++
+	}
+	if n != count {
+		t.Fatalf("%s: expected %d values, got %d", method, count, n)
+	}
+	if errText == "" && c.Error != nil {
+		t.Fatalf("%s: unexpected error: %v", method, c.Error)
+	}
+	if errText != "" && (c.Error == nil || !strings.Contains(c.Error.Error(), errText)) {
+		t.Fatalf("%s: expected error %q, got %v", method, errText, c.Error)
+	}
+}
+
+func testStream(t *testing.T, l *link) {
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+	stream(t, l, "StreamingArith.Thrive", 0, "")
+}
+
+func testStreamError(t *testing.T, l *link) {
+	rowChan := make(chan *StreamingReply, 10)
+	c := l.client.StreamGo("StreamingArith.Thrive", &StreamingArgs{3, 10, 5}, rowChan)
+	n := 0
+	for range rowChan {
+		n++
+	}
+	if n != 5 {
+		t.Fatal("expected 5 values before the error, got", n)
+	}
+	if c.Error == nil || c.Error.Error() != "Triggered error in middle" {
+		t.Fatal("expected the error of the method, got", c.Error)
+	}
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+}
+
+func testCloseStream(t *testing.T, l *link) {
+	rowChan := make(chan *StreamingReply)
+	c := l.client.StreamGo("StreamingArith.Forever", &StreamingArgs{}, rowChan)
+	<-rowChan
+	if err := c.CloseStream(); err != nil {
+		t.Fatal("CloseStream:", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for range rowChan {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not stopped")
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+}
+
+func testStreamPanic(t *testing.T, l *link) {
+	stream(t, l, "StreamingArith.Panic", 5, "rpc: panic serving StreamingArith.Panic: stream panic")
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+}
+
+func testClientStream(t *testing.T, l *link) {
+	reply := new(StreamingReply)
+	c := l.client.SendStreamGo("StreamingArith.Sum", reply, nil)
+	for i := 1; i <= 10; i++ {
+		if err := c.Send(&StreamingArgs{A: i}); err != nil {
+			t.Fatal("Send:", err)
+		}
+	}
+	if err := c.CloseSend(); err != nil {
+		t.Fatal("CloseSend:", err)
+	}
+	<-c.Done
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	if reply.C != 55 || reply.Index != 10 {
+		t.Fatalf("Sum: expected 55 from 10 values, got %d from %d", reply.C, reply.Index)
+	}
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+}
+
+func testBidiStream(t *testing.T, l *link) {
+	rowChan := make(chan *StreamingReply)
+	c := l.client.BidiStreamGo("StreamingArith.Echo", rowChan)
+	for i := 0; i < 10; i++ {
+		if err := c.Send(&StreamingArgs{A: i * 2}); err != nil {
+			t.Fatal("Send:", err)
+		}
+		row, ok := <-rowChan
+		if !ok {
+			t.Fatal("unexpected closed channel")
+		}
+		if row.C != i*2 || row.Index != i {
+			t.Fatalf("Echo: expected %d at %d, got %d at %d", i*2, i, row.C, row.Index)
+		}
+	}
+	if err := c.CloseSend(); err != nil {
+		t.Fatal("CloseSend:", err)
+	}
+	for range rowChan {
+		t.Fatal("unexpected value after CloseSend")
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+}
+
+func testFlowControl(t *testing.T, l *link) {
+	l.client.SetStreamWindow(4)
+
+	// nobody reads the replies for now
+	rowChan := make(chan *StreamingReply)
+	c := l.client.StreamGo("StreamingArith.Counted", &StreamingArgs{3, 100, -1}, rowChan)
+
+	// the slow stream does not hold up other calls
+	stream(t, l, "StreamingArith.Thrive", 5, "")
+
+	// the server waits for credit once the window is used up: the count
+	// of values sent reaches it, and stays there
+	deadline := time.Now().Add(5 * time.Second)
+	for stable := 0; stable < 10; time.Sleep(10 * time.Millisecond) {
+		switch sent := atomic.LoadInt32(&l.streaming.sent); {
+		case sent > 4:
+			t.Fatal("server sent more than the window ahead of the reader:", sent)
+		case sent == 4:
+			stable++
+		case time.Now().After(deadline):
+			t.Fatal("server sent only", sent, "values of the window")
+		}
+	}
+
+	n := 0
+	for row := range rowChan {
+		if row.Index != n {
+			t.Fatal("unexpected value:", row.Index)
+		}
+		n++
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	if n != 100 {
+		t.Fatal("Didn't receive the right number of packets back:", n)
+	}
+}
@@ -14,7 +14,8 @@
 	other methods will be ignored:
 
 		- the method is exported.
-		- the method has two arguments, both exported (or builtin) types.
+		- the method has two arguments, both exported (or builtin) types,
+		  optionally preceded by a context argument.
 		- the method's second argument is either a pointer, or a rpcplus.Stream.
 		- the method has return type error.
 
@@ -23,6 +24,33 @@
 		func (t *T) MethodName(argType T1, replyType *T2) error
 		func (t *T) MethodName(argType T1, stream rpcplus.Stream) error
 
+	A method whose first argument is a receive-only channel of pointers consumes
+	a stream of values sent by the client with Call.Send; the channel is closed
+	when the client calls Call.CloseSend.  The values wait in a queue until the
+	method receives them; a call whose method falls more than MaxQueuedArgs
+	values behind fails with CodeResourceExhausted.  Combined with a
+	rpcplus.Stream, this gives a bidirectional stream:
+
+		func (t *T) MethodName(in <-chan *T1, replyType *T2) error
+		func (t *T) MethodName(in <-chan *T1, stream rpcplus.Stream) error
+
+	If the first argument is a context.Context, it is cancelled when the
+	connection is closed or when the client abandons the call (for example
+	with Call.CloseStream):
+
+		func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+
+	The context also carries the metadata sent by the client (see
+	MetadataFromContext), and lets the method send metadata back with
+	SetResponseMetadata.
+
+	Any other type in that position receives the connection context passed
+	to ServeConnWithContext or ServeCodecWithContext.  If the connection
+	context is of another type, or there is none, a method taking the type
+	set with SetContextType receives a new value of that type, shared by the
+	calls on the connection, and other methods the zero value.  Over TLS, the
+	connection context is the *PeerIdentity of the client (see ListenTLS).
+
 	where T, T1 and T2 can be marshaled by encoding/gob.
 	These requirements apply even if a different codec is used.
 	(In the future, these requirements may soften for custom codecs.)
@@ -31,8 +59,10 @@
 	second argument represents the result parameters to be returned to the caller,
 	or the function to call to send results.
 	The method's return value, if non-nil, is passed back as a string that the client
-	sees as if created by errors.New.  If an error is returned, the reply parameter
-	will not be sent back to the client.
+	sees as if created by errors.New, unless it is (or wraps) an *Error, whose code
+	and details are sent along.  If an error is returned, the reply parameter
+	will not be sent back to the client.  A panic in a method is recovered and
+	reported to the client as an error beginning with "rpc: panic serving ".
 
 	The server may handle requests on a single connection by calling ServeConn.  More
 	typically it will create a network listener and call Accept or, for an HTTP
@@ -45,13 +75,23 @@
 	call, a pointer containing the arguments, and a pointer to receive the result
 	parameters. It also has a StreamGo method, that specifies a reply channel
 	to receive the results in the case of streaming RPCs.
+	NewReconnectingClient wraps a dial function, such as one calling Dial, in a
+	client that dials again with backoff whenever the connection is lost.
 
 	The Call method waits for the remote call to complete while the Go method
 	launches the call asynchronously and signals completion using the Call
 	structure's Done channel. The StreamGo method is always asynchronous.
+	The replies of a stream are sent on its channel by the goroutine reading
+	the connection, so a slow reader holds up every call of the client,
+	unless the client sets a window (see Client.SetStreamWindow): the server
+	then sends at most a window of replies ahead of the reader.
 
 	Unless an explicit codec is set up, package encoding/gob is used to
-	transport the data.
+	transport the data.  Codecs registered with RegisterCodec under a media
+	type can be negotiated by NewHTTPClient when connecting over HTTP.
+	Compression of the connection (see NewFlateConn) can be negotiated too,
+	or set up on both ends of a raw connection; the WithCompression option
+	of Dial and DialHTTP asks for it.
 
 	Here is a simple example.  A server wishes to export an object of type Arith:
 
@@ -126,15 +166,19 @@ package rpcplus
 
 import (
 	"bufio"
+	"context"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -150,6 +194,9 @@ const (
 // because Typeof takes an empty interface value.  This is annoying.
 var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 
+// Same for context.Context.
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // RequestLogEntry: a request/response log entry that includes
 // timing information and the full RPC method name
 type RequestLogEntry struct {
@@ -158,6 +205,8 @@ type RequestLogEntry struct {
 	End           time.Time `json:"end"`
 	Duration      int64     `json:"duration"`
 	RequestMethod *string   `json:"request_method"`
+	Panic         string    `json:"panic,omitempty"`       // value recovered from a panicking method
+	PanicStack    string    `json:"panic_stack,omitempty"` // stack trace of the panic
 }
 
 type methodType struct {
@@ -166,7 +215,8 @@ type methodType struct {
 	ArgType     reflect.Type
 	ReplyType   reflect.Type
 	ContextType reflect.Type
-	stream      bool
+	stream      bool // the method sends a stream of replies
+	recvStream  bool // the method receives a stream of arguments
 	numCalls    uint
 }
 
@@ -174,6 +224,12 @@ func (m *methodType) TakesContext() bool {
 	return m.ContextType != nil
 }
 
+// TakesCallContext reports whether the method's context argument is a
+// context.Context rather than the connection context.
+func (m *methodType) TakesCallContext() bool {
+	return m.ContextType == typeOfContext
+}
+
 type service struct {
 	name   string                 // name of service
 	rcvr   reflect.Value          // receiver of methods for the service
@@ -185,22 +241,39 @@ type service struct {
 // but documented here as an aid to debugging, such as when analyzing
 // network traffic.
 type Request struct {
-	ServiceMethod string   // format: "Service.Method"
-	Seq           uint64   // sequence number chosen by client
-	next          *Request // for free list in Server
+	ServiceMethod string            // format: "Service.Method"
+	Seq           uint64            // sequence number chosen by client
+	Deadline      time.Time         // deadline of the call, zero if none
+	Window        uint32            // flow control window of a stream, 0 if none; credit returned by StreamCredit
+	Metadata      map[string]string // sent by the client, see WithMetadata
+	next          *Request          // for free list in Server
 }
 
 // Response is a header written before every RPC return.  It is used internally
 // but documented here as an aid to debugging, such as when analyzing
 // network traffic.
 type Response struct {
-	ServiceMethod string    // echoes that of the Request
-	Seq           uint64    // echoes that of the request
-	Error         string    // error, if any.
-	next          *Response // for free list in Server
+	ServiceMethod string            // echoes that of the Request
+	Seq           uint64            // echoes that of the request
+	Error         string            // error, if any.
+	ErrorCode     ErrorCode         // code of the error, if it is an *Error
+	ErrorDetails  map[string]string // details of the error, if it is an *Error
+	Metadata      map[string]string // set by the method, see SetResponseMetadata
+	next          *Response         // for free list in Server
 }
 
-const lastStreamResponseError = "EOS"
+// EndOfStream is the Error of the last response of a stream that ended
+// successfully.  Codecs with a framing of their own for the end of a
+// stream translate it.
+const EndOfStream = "EOS"
+
+// errEndOfStream is sent as the error of the last response of a stream
+// that ended successfully.
+var errEndOfStream = errors.New(EndOfStream)
+
+// panicErrorPrefix starts the error returned to the client when a method
+// panics.
+const panicErrorPrefix = "rpc: panic serving "
 
 type Logger func(*RequestLogEntry)
 
@@ -213,6 +286,15 @@ type Server struct {
 	respLock    sync.Mutex // protects freeResp
 	freeResp    *Response
 	contextType reflect.Type
+
+	// protected by mu, replaced rather than appended to in place
+	interceptors       []Interceptor
+	streamInterceptors []StreamInterceptor
+
+	// protected by mu
+	shutdown  bool
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
 }
 
 // NewServer returns a new Server.
@@ -276,7 +358,7 @@ func prepareMethod(method reflect.Method) *methodType {
 	mname := method.Name
 	var replyType, argType, contextType reflect.Type
 
-	stream := false
+	stream, recvStream := false, false
 	// Method must be exported.
 	if method.PkgPath != "" {
 		return nil
@@ -304,6 +386,20 @@ func prepareMethod(method reflect.Method) *methodType {
 		return nil
 	}
 
+	// a receive-only channel of pointers makes it a call that
+	// receives a stream of arguments
+	if argType.Kind() == reflect.Chan {
+		if argType.ChanDir() != reflect.RecvDir || argType.Elem().Kind() != reflect.Ptr {
+			log.Println("method", mname, "argument channel is not a receive-only channel of pointers:", argType)
+			return nil
+		}
+		if !isExportedOrBuiltinType(argType.Elem()) {
+			log.Println(mname, "argument type not exported:", argType)
+			return nil
+		}
+		recvStream = true
+	}
+
 	// the second argument will tell us if it's a streaming call
 	// or a regular call
 	if replyType == typeOfStream {
@@ -329,7 +425,7 @@ func prepareMethod(method reflect.Method) *methodType {
 		log.Println("method", mname, "returns", returnType.String(), "not error")
 		return nil
 	}
-	return &methodType{method: method, ArgType: argType, ReplyType: replyType, ContextType: contextType, stream: stream}
+	return &methodType{method: method, ArgType: argType, ReplyType: replyType, ContextType: contextType, stream: stream, recvStream: recvStream}
 }
 
 func (server *Server) register(rcvr interface{}, name string, useName bool) error {
@@ -381,17 +477,18 @@ func (server *Server) register(rcvr interface{}, name string, useName bool) erro
 // contains an error when it is used.
 var invalidRequest = struct{}{}
 
-func (server *Server) sendResponse(sending *sync.Mutex, req *Request, reply interface{}, codec ServerCodec, errmsg string, last bool) (err error) {
+func (server *Server) sendResponse(sending *sync.Mutex, req *Request, reply interface{}, codec ServerCodec, callErr error, metadata map[string]string, last bool) (err error) {
 	resp := server.getResponse()
 	// Encode the response header
 	resp.ServiceMethod = req.ServiceMethod
-	if errmsg != "" {
-		resp.Error = errmsg
+	if callErr != nil {
+		resp.setError(callErr)
 		reply = invalidRequest
 	}
 	resp.Seq = req.Seq
+	resp.Metadata = metadata
 	sending.Lock()
-	codec.WriteResponse(resp, reply, last)
+	err = codec.WriteResponse(resp, reply, last)
 	sending.Unlock()
 	server.freeResponse(resp)
 	return err
@@ -407,42 +504,125 @@ func (m *methodType) NumCalls() (n uint) {
 var nilRes = []reflect.Value{reflect.Zero(typeOfError)}
 
 type call struct {
-	server  *Server
-	sending *sync.Mutex
-	mtype   *methodType
-	req     *Request
-	argv    reflect.Value
-	replyv  reflect.Value
-	codec   ServerCodec
-	context reflect.Value
-	eof     <-chan struct{}
-	stop    <-chan struct{}
-	done    chan<- struct{}
+	server         *Server
+	sending        *sync.Mutex
+	mtype          *methodType
+	req            *Request
+	argv           reflect.Value
+	replyv         reflect.Value
+	codec          ServerCodec
+	context        reflect.Value
+	defaultContext reflect.Value // passed to methods if context is of another type
+	ctx            context.Context
+	cancel         context.CancelFunc
+	log            *RequestLogEntry
+	eof            <-chan struct{}
+	drain          <-chan struct{}
+	stop           <-chan struct{}
+	done           chan<- struct{}
+	credit         *streamCredit // nil unless the client controls the flow of the stream
+	recv           *valueQueue   // the stream of arguments, nil if none
+	md             *callMetadata
+}
+
+// errArgsOverflow fails a call whose method fell more than MaxQueuedArgs
+// values behind its client.
+var errArgsOverflow = NewError(CodeResourceExhausted, "rpc: too many stream values queued for the method")
+
+// activeCall is the state of a call in progress, found by the sequence
+// number of the requests controlling it.
+type activeCall struct {
+	stop   chan struct{} // closed when the client abandons the call
+	recv   *valueQueue   // the stream of arguments, nil if none
+	credit *streamCredit // nil unless the client controls the flow of the stream
+}
+
+// contextArg returns the value passed as the context argument of the
+// method: the per-call context.Context or the connection context.
+func (c *call) contextArg() reflect.Value {
+	if c.mtype.TakesCallContext() {
+		return reflect.ValueOf(c.ctx)
+	}
+	if c.context.Type().AssignableTo(c.mtype.ContextType) {
+		return c.context
+	}
+	// a connection context of another type, such as the *PeerIdentity
+	// of a TLS connection for a method taking the SetContextType type
+	if c.defaultContext.Type().AssignableTo(c.mtype.ContextType) {
+		return c.defaultContext
+	}
+	return reflect.Zero(c.mtype.ContextType)
+}
+
+// invoke runs fn, which calls the method through the interceptors, and
+// returns its error.  A panic is recovered, recorded in the log entry and
+// returned as an error, so that it does not take down the server.
+func (c *call) invoke(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			log.Printf("rpc: panic serving %s: %v\n%s", c.req.ServiceMethod, r, buf)
+			c.log.Panic = fmt.Sprint(r)
+			c.log.PanicStack = string(buf)
+			err = NewError(CodeInternal, panicErrorPrefix+c.req.ServiceMethod+": "+c.log.Panic)
+		}
+	}()
+	return fn()
+}
+
+// handler returns the Handler that finally calls the method, passing
+// reply as its second argument.
+func (s *service) handler(c *call, reply reflect.Value) Handler {
+	function := c.mtype.method.Func
+	return func(sc *ServerCall) error {
+		in := []reflect.Value{s.rcvr}
+		if c.mtype.TakesContext() {
+			in = append(in, c.contextArg())
+		}
+		argv := reflect.ValueOf(sc.Args)
+		if !argv.IsValid() || !argv.Type().AssignableTo(c.mtype.ArgType) {
+			// calling the method would panic
+			return NewError(CodeInternal, fmt.Sprintf("rpc: interceptor replaced the argument of %s with %T, want %s", sc.ServiceMethod, sc.Args, c.mtype.ArgType))
+		}
+		in = append(in, argv, reply)
+		// The return value for the method is an error.
+		if errInter := function.Call(in)[0].Interface(); errInter != nil {
+			return errInter.(error)
+		}
+		return nil
+	}
 }
 
 func (s *service) call(c call) {
 	c.mtype.Lock()
 	c.mtype.numCalls++
 	c.mtype.Unlock()
-	function := c.mtype.method.Func
-	var returnValues []reflect.Value
+	interceptors, streamInterceptors := c.server.interceptorChain()
+	sc := &ServerCall{
+		ServiceMethod: c.req.ServiceMethod,
+		Context:       c.ctx,
+		ConnContext:   c.context.Interface(),
+		Args:          c.argv.Interface(),
+		Stream:        c.mtype.stream,
+	}
+	var err error
 
 	if !c.mtype.stream {
 
 		// Invoke the method, providing a new value for the reply.
-		if c.mtype.TakesContext() {
-			returnValues = function.Call([]reflect.Value{s.rcvr, c.context, c.argv, c.replyv})
-		} else {
-			returnValues = function.Call([]reflect.Value{s.rcvr, c.argv, c.replyv})
+		sc.Reply = c.replyv.Interface()
+		handler := s.handler(&c, c.replyv)
+		err = c.invoke(func() error { return intercept(interceptors, sc, handler) })
+		if err == nil && (sc.Reply == nil || !reflect.TypeOf(sc.Reply).AssignableTo(c.mtype.ReplyType)) {
+			// the client could not decode it
+			err = NewError(CodeInternal, fmt.Sprintf("rpc: interceptor replaced the reply of %s with %T, want %s", sc.ServiceMethod, sc.Reply, c.mtype.ReplyType))
 		}
-
-		// The return value for the method is an error.
-		errInter := returnValues[0].Interface()
-		errmsg := ""
-		if errInter != nil {
-			errmsg = errInter.(error).Error()
+		if c.recv != nil && c.recv.overflowed() {
+			err = errArgsOverflow
 		}
-		c.server.sendResponse(c.sending, c.req, c.replyv.Interface(), c.codec, errmsg, true)
+
+		c.server.sendResponse(c.sending, c.req, sc.Reply, c.codec, err, c.md.responseMetadata(), true)
 		c.server.freeRequest(c.req)
 		close(c.done)
 		return
@@ -454,54 +634,81 @@ func (s *service) call(c call) {
 	funcDone := make(chan struct{})
 	sendDone := make(chan struct{})
 
+	// signal reports err to the method, unless it has already returned
+	// (methods taking a context.Context need not read stream.Error).
+	signal := func(err error) {
+		select {
+		case errChan <- err:
+		case <-funcDone:
+		}
+	}
+
 	var streamErr error
 	go func() {
 		defer close(sendDone)
 		for {
+			// without credit, leave the method blocked on
+			// stream.Send until the client returns some
+			in, credit := sendChan, (chan struct{})(nil)
+			if c.credit != nil && !c.credit.take() {
+				in, credit = nil, c.credit.ready
+			}
 			select {
-			case data := <-sendChan:
-				streamErr = c.server.sendResponse(c.sending, c.req, data, c.codec, "", false)
+			case <-credit:
+				continue
+			case data := <-in:
+				for _, interceptor := range streamInterceptors {
+					if data, streamErr = interceptor(sc, data); streamErr != nil {
+						signal(streamErr)
+						return
+					}
+				}
+				streamErr = c.server.sendResponse(c.sending, c.req, data, c.codec, nil, nil, false)
 				if streamErr != nil {
-					errChan <- streamErr
+					signal(streamErr)
 					return
 				}
 			case <-funcDone:
 				return
 			case <-c.eof:
-				errChan <- io.EOF
+				signal(io.EOF)
 				return
 			case <-c.stop:
-				errChan <- io.EOF
+				signal(io.EOF)
+				return
+			case <-c.drain:
+				// the server is shutting down
+				streamErr = ErrServerShutdown
+				c.cancel()
+				signal(streamErr)
 				return
 			}
 		}
 	}()
 
 	// Invoke the method, providing a new value for the reply.
-	if c.mtype.TakesContext() {
-		returnValues = function.Call([]reflect.Value{s.rcvr, c.context, c.argv, stream})
-	} else {
-		returnValues = function.Call([]reflect.Value{s.rcvr, c.argv, stream})
-	}
+	handler := s.handler(&c, stream)
+	err = c.invoke(func() error { return intercept(interceptors, sc, handler) })
 	close(funcDone)
 	<-sendDone
 
-	errInter := returnValues[0].Interface()
-	errmsg := ""
-	if errInter != nil {
-		// the function returned an error, we use that
-		errmsg = errInter.(error).Error()
-	} else if streamErr != nil {
-		errmsg = streamErr.Error()
-	} else {
-		// no error, we send the special EOS error
-		errmsg = lastStreamResponseError
+	if c.recv != nil && c.recv.overflowed() {
+		err = errArgsOverflow
 	}
+	if err == nil {
+		if streamErr != nil {
+			err = streamErr
+		} else {
+			// no error, we send the special EOS error
+			err = errEndOfStream
+		}
+	}
+	// otherwise the function returned an error (or panicked), we use that
 
 	// this is the last packet, we don't do anything with
 	// the error here (well sendStreamResponse will log it
 	// already)
-	c.server.sendResponse(c.sending, c.req, nil, c.codec, errmsg, true)
+	c.server.sendResponse(c.sending, c.req, nil, c.codec, err, c.md.responseMetadata(), true)
 	c.server.freeRequest(c.req)
 	close(c.done)
 }
@@ -547,9 +754,7 @@ func (server *Server) ServeConn(conn io.ReadWriteCloser, loggers ...Logger) {
 // ServeConnWithContext is like ServeConn but makes it possible to
 // pass a connection context to the RPC methods.
 func (server *Server) ServeConnWithContext(conn io.ReadWriteCloser, context interface{}, loggers ...Logger) {
-	buf := bufio.NewWriter(conn)
-	srv := &gobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
-	server.ServeCodecWithContext(srv, context, loggers...)
+	server.ServeCodecWithContext(newGobServerCodec(conn), context, loggers...)
 }
 
 // ServeCodec is like ServeConn but uses the specified codec to
@@ -560,18 +765,26 @@ func (server *Server) ServeCodec(codec ServerCodec, loggers ...Logger) {
 
 // ServeCodecWithContext is like ServeCodec but it makes it possible
 // to pass a connection context to the RPC methods.
-func (server *Server) ServeCodecWithContext(codec ServerCodec, context interface{}, loggers ...Logger) {
+func (server *Server) ServeCodecWithContext(codec ServerCodec, connContext interface{}, loggers ...Logger) {
 	sending := new(sync.Mutex)
+	sc := server.trackConn(codec, sending)
+	if sc == nil {
+		// the server has been shut down
+		codec.Close()
+		return
+	}
+	defer server.untrackConn(sc)
 	eof := make(chan struct{})
+	connCtx, cancelConn := context.WithCancel(context.Background())
 
-	stopChans := make(map[uint64]chan struct{})
-	var stopChansMtx sync.Mutex
+	calls := make(map[uint64]*activeCall)
+	var callsMtx sync.Mutex
 
-	var contextVal reflect.Value
-	if context != nil {
-		contextVal = reflect.ValueOf(context)
-	} else {
-		contextVal = reflect.New(server.contextType)
+	defaultContext := reflect.New(server.contextType)
+	contextVal := defaultContext
+	if connContext != nil {
+		contextVal = reflect.ValueOf(connContext)
+		connCtx = context.WithValue(connCtx, connContextKey{}, connContext)
 	}
 
 	requestLogMap := make(map[uint64]*RequestLogEntry)
@@ -602,66 +815,160 @@ func (server *Server) ServeCodecWithContext(codec ServerCodec, context interface
 			// an error here means the request was malformed
 			// we won't bother to log these requests/responses
 			if err == errCloseStream {
+				// the call is logged once it has returned
 				go func(seq uint64) {
-					stopChansMtx.Lock()
-					stop, ok := stopChans[seq]
-					delete(stopChans, seq)
-					stopChansMtx.Unlock()
-					maybeLog(seq)
+					callsMtx.Lock()
+					ac, ok := calls[seq]
+					delete(calls, seq)
+					callsMtx.Unlock()
 					if !ok {
 						return
 					}
-					close(stop)
+					close(ac.stop)
+					if ac.recv != nil {
+						ac.recv.close()
+					}
 				}(req.Seq)
 				continue
 			}
+			if err == errStreamSend || err == errCloseSend || err == errStreamCredit {
+				callsMtx.Lock()
+				ac := calls[req.Seq]
+				callsMtx.Unlock()
+				// except for a stream value, the body has been
+				// discarded already
+				switch {
+				case err == errCloseSend:
+					if ac != nil && ac.recv != nil {
+						ac.recv.close()
+					}
+				case err == errStreamCredit:
+					if ac != nil && ac.credit != nil {
+						ac.credit.add(req.Window)
+					}
+				case ac == nil || ac.recv == nil:
+					// the call is over, or never received a stream
+					codec.ReadRequestBody(nil)
+				default:
+					v := reflect.New(ac.recv.ch.Type().Elem().Elem())
+					if err := codec.ReadRequestBody(v.Interface()); err != nil {
+						log.Printf("rpc: cannot decode stream value for call %d: %v", req.Seq, err)
+					} else if !ac.recv.push(v) {
+						// the method is too far behind: stop
+						// the call, which fails once it returns
+						callsMtx.Lock()
+						if calls[req.Seq] == ac {
+							delete(calls, req.Seq)
+							close(ac.stop)
+						}
+						callsMtx.Unlock()
+					}
+				}
+				server.freeRequest(req)
+				continue
+			}
 			if !keepReading {
 				break
 			}
 			// send a response if we actually managed to read a header.
 			if req != nil {
-				server.sendResponse(sending, req, invalidRequest, codec, err.Error(), true)
+				server.sendResponse(sending, req, invalidRequest, codec, err, nil, true)
 				server.freeRequest(req)
 			}
 			continue
 		}
-		requestLogMapMtx.Lock()
-		requestLogMap[req.Seq] = &RequestLogEntry{
+		if !sc.begin() {
+			server.sendResponse(sending, req, invalidRequest, codec, ErrServerShutdown, nil, true)
+			server.freeRequest(req)
+			continue
+		}
+		// req is recycled once the call returns, so the entry
+		// needs its own copy of the method name.
+		method := req.ServiceMethod
+		logEntry := &RequestLogEntry{
 			RequestId:     req.Seq,
 			Start:         time.Now(),
-			RequestMethod: &req.ServiceMethod,
+			RequestMethod: &method,
 		}
+		requestLogMapMtx.Lock()
+		requestLogMap[req.Seq] = logEntry
 		requestLogMapMtx.Unlock()
 		done := make(chan struct{})
 		stop := make(chan struct{})
-		stopChansMtx.Lock()
-		stopChans[req.Seq] = stop
-		stopChansMtx.Unlock()
+		ac := &activeCall{stop: stop}
+		if mtype.recvStream {
+			ac.recv = newValueQueue(argv, MaxQueuedArgs, nil)
+		}
+		if mtype.stream && req.Window > 0 {
+			ac.credit = newStreamCredit(req.Window)
+		}
+		callsMtx.Lock()
+		calls[req.Seq] = ac
+		callsMtx.Unlock()
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if req.Deadline.IsZero() {
+			ctx, cancel = context.WithCancel(connCtx)
+		} else {
+			ctx, cancel = context.WithDeadline(connCtx, req.Deadline)
+		}
+		md := &callMetadata{request: req.Metadata}
+		ctx = context.WithValue(ctx, incomingMetadataKey{}, md)
 
 		go func(seq uint64) {
-			<-done
-			stopChansMtx.Lock()
-			delete(stopChans, seq)
-			stopChansMtx.Unlock()
+			select {
+			case <-done:
+			case <-stop:
+				// the client abandoned the call
+				cancel()
+				<-done
+			}
+			cancel()
+			if ac.recv != nil {
+				// nobody receives the values left
+				ac.recv.stop()
+			}
+			callsMtx.Lock()
+			if calls[seq] == ac {
+				delete(calls, seq)
+			}
+			callsMtx.Unlock()
 			maybeLog(seq)
+			sc.end()
 		}(req.Seq)
 
 		go service.call(call{
-			server:  server,
-			sending: sending,
-			mtype:   mtype,
-			req:     req,
-			argv:    argv,
-			replyv:  replyv,
-			codec:   codec,
-			context: contextVal,
-			eof:     eof,
-			done:    done,
-			stop:    stop,
+			server:         server,
+			sending:        sending,
+			mtype:          mtype,
+			req:            req,
+			argv:           argv,
+			replyv:         replyv,
+			codec:          codec,
+			context:        contextVal,
+			defaultContext: defaultContext,
+			ctx:            ctx,
+			cancel:         cancel,
+			log:            logEntry,
+			eof:            eof,
+			drain:          sc.drain,
+			done:           done,
+			stop:           stop,
+			credit:         ac.credit,
+			recv:           ac.recv,
+			md:             md,
 		})
 	}
 	close(eof)
-	codec.Close()
+	cancelConn()
+	callsMtx.Lock()
+	for _, ac := range calls {
+		if ac.recv != nil {
+			ac.recv.close()
+		}
+	}
+	callsMtx.Unlock()
+	sc.close()
 }
 
 func (server *Server) getRequest() *Request {
@@ -707,7 +1014,8 @@ func (server *Server) freeResponse(resp *Response) {
 func (server *Server) readRequest(codec ServerCodec) (service *service, mtype *methodType, req *Request, argv, replyv reflect.Value, keepReading bool, err error) {
 	service, mtype, req, keepReading, err = server.readRequestHeader(codec)
 	if err != nil {
-		if !keepReading {
+		if !keepReading || err == errStreamSend {
+			// the body of a stream value is decoded by the caller
 			return
 		}
 		// discard body
@@ -715,6 +1023,18 @@ func (server *Server) readRequest(codec ServerCodec) (service *service, mtype *m
 		return
 	}
 
+	if mtype.recvStream {
+		// the arguments follow in separate requests
+		if err = codec.ReadRequestBody(nil); err != nil {
+			return
+		}
+		argv = reflect.MakeChan(reflect.ChanOf(reflect.BothDir, mtype.ArgType.Elem()), 0)
+		if !mtype.stream {
+			replyv = reflect.New(mtype.ReplyType.Elem())
+		}
+		return
+	}
+
 	// Decode the argument value.
 	argIsValue := false // if true, need to indirect before calling.
 	if mtype.ArgType.Kind() == reflect.Ptr {
@@ -725,6 +1045,7 @@ func (server *Server) readRequest(codec ServerCodec) (service *service, mtype *m
 	}
 	// argv guaranteed to be a pointer now.
 	if err = codec.ReadRequestBody(argv.Interface()); err != nil {
+		err = NewError(CodeBadArgument, err.Error())
 		return
 	}
 	if argIsValue {
@@ -737,7 +1058,37 @@ func (server *Server) readRequest(codec ServerCodec) (service *service, mtype *m
 	return
 }
 
-var errCloseStream = errors.New("rpc: close stream")
+// CloseStreamServiceMethod is the ServiceMethod of the request sent by
+// Call.CloseStream: the server stops the call with the same sequence
+// number.  Codecs with a cancel message of their own translate it.
+const CloseStreamServiceMethod = "CloseStream"
+
+// Requests with these service methods also control a call in progress, the
+// one with the same sequence number.
+const (
+	streamSendServiceMethod   = "StreamSend"   // a value for a method receiving a stream
+	closeSendServiceMethod    = "CloseSend"    // the client has no more values to send
+	streamCreditServiceMethod = "StreamCredit" // the client returns Window values of credit
+)
+
+// IsControlMethod reports whether requests with the given service method
+// control the call in progress with the same sequence number instead of
+// starting a call.  Codecs translating request ids to sequence numbers reuse
+// the sequence number of a call in progress only for these.
+func IsControlMethod(serviceMethod string) bool {
+	switch serviceMethod {
+	case CloseStreamServiceMethod, streamSendServiceMethod, closeSendServiceMethod, streamCreditServiceMethod:
+		return true
+	}
+	return false
+}
+
+var (
+	errCloseStream  = errors.New("rpc: close stream")
+	errStreamSend   = errors.New("rpc: stream send")
+	errCloseSend    = errors.New("rpc: close send")
+	errStreamCredit = errors.New("rpc: stream credit")
+)
 
 func (server *Server) readRequestHeader(codec ServerCodec) (service *service, mtype *methodType, req *Request, keepReading bool, err error) {
 	// Grab the request header.
@@ -756,14 +1107,30 @@ func (server *Server) readRequestHeader(codec ServerCodec) (service *service, mt
 	// we can still recover and move on to the next request.
 	keepReading = true
 
-	if req.ServiceMethod == "CloseStream" {
+	switch req.ServiceMethod {
+	case CloseStreamServiceMethod:
 		err = errCloseStream
 		return
+	case streamSendServiceMethod:
+		err = errStreamSend
+		return
+	case closeSendServiceMethod:
+		err = errCloseSend
+		return
+	case streamCreditServiceMethod:
+		err = errStreamCredit
+		return
 	}
 
+	if req.ServiceMethod == "" {
+		err = NewError(CodeInvalidRequest, "rpc: service/method request ill-formed: "+req.ServiceMethod)
+		return
+	}
 	serviceMethod := strings.Split(req.ServiceMethod, ".")
 	if len(serviceMethod) != 2 {
-		err = errors.New("rpc: service/method request ill-formed: " + req.ServiceMethod)
+		// the request is well formed, but names no method of a
+		// service
+		err = NewError(CodeUnknownService, "rpc: can't find service "+req.ServiceMethod)
 		return
 	}
 	// Look up the request.
@@ -771,29 +1138,63 @@ func (server *Server) readRequestHeader(codec ServerCodec) (service *service, mt
 	service = server.serviceMap[serviceMethod[0]]
 	server.mu.Unlock()
 	if service == nil {
-		err = errors.New("rpc: can't find service " + req.ServiceMethod)
+		err = NewError(CodeUnknownService, "rpc: can't find service "+req.ServiceMethod)
 		return
 	}
 	mtype = service.method[serviceMethod[1]]
 	if mtype == nil {
-		err = errors.New("rpc: can't find method " + req.ServiceMethod)
+		err = NewError(CodeUnknownMethod, "rpc: can't find method "+req.ServiceMethod)
 	}
 	return
 }
 
 // Accept accepts connections on the listener and serves requests
-// for each incoming connection.  Accept blocks; the caller typically
-// invokes it in a go statement.
+// for each incoming connection.  Accept blocks until the listener fails
+// or the server is shut down; the caller typically invokes it in a go
+// statement.  TLS connections, from a listener such as ListenTLS returns,
+// have the *PeerIdentity of the client as their connection context.
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
+
+	var delay time.Duration // how long to sleep on temporary failures
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Fatal("rpc.Serve: accept:", err.Error()) // TODO(r): exit?
+			if server.isShutdown() {
+				return
+			}
+			if retryAccept(err) {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("rpc.Serve: accept: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			log.Print("rpc.Serve: accept:", err.Error())
+			return
 		}
-		go server.ServeConn(conn)
+		delay = 0
+		go server.serveAccepted(conn)
 	}
 }
 
+// retryAccept reports whether Accept may succeed again after failing with
+// err: the process ran out of file descriptors, or the listener timed out.
+func retryAccept(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 // Register publishes the receiver's methods in the DefaultServer.
 func Register(rcvr interface{}) error { return DefaultServer.Register(rcvr) }
 
@@ -853,7 +1254,8 @@ func Accept(lis net.Listener) { DefaultServer.Accept(lis) }
 // Can connect to RPC service using HTTP CONNECT to rpcPath.
 var connected = "200 Connected to Go RPC"
 
-// ServeHTTP implements an http.Handler that answers RPC requests.
+// ServeHTTP implements an http.Handler that answers RPC requests.  Over
+// HTTPS, the connection context is the *PeerIdentity of the client.
 func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -866,8 +1268,13 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
 		return
 	}
+	if AcceptsEncoding(req.Header.Get("Accept-Encoding"), FlateEncoding) {
+		io.WriteString(conn, "HTTP/1.0 "+connected+"\nContent-Encoding: "+FlateEncoding+"\n\n")
+		server.ServeConnWithContext(NewFlateConn(conn), ConnContext(req))
+		return
+	}
 	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
-	server.ServeConn(conn)
+	server.ServeConnWithContext(conn, ConnContext(req))
 }
 
 // HandleHTTP registers an HTTP handler for RPC messages on rpcPath,
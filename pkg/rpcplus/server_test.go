@@ -5,16 +5,19 @@
 package rpcplus
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http/httptest"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -74,10 +77,45 @@ func (t *Arith) Error(args *Args, reply *Reply) error {
 	panic("ERROR")
 }
 
+const CodeTooLarge ErrorCode = 1000
+
+func (t *Arith) Checked(args Args, reply *Reply) error {
+	if args.A > 100 {
+		err := &Error{Code: CodeTooLarge, Message: "too large", Details: map[string]string{"max": "100"}}
+		return fmt.Errorf("Checked: %w", err)
+	}
+	reply.C = args.A
+	return nil
+}
+
 func (t *Arith) TakesContext(context *string, args string, reply *string) error {
 	return nil
 }
 
+// Waiter reports the calls of WaitForCancel to the test that registered it.
+type Waiter struct {
+	started   chan struct{}
+	cancelled chan error
+}
+
+func newWaiter() *Waiter {
+	return &Waiter{started: make(chan struct{}, 1), cancelled: make(chan error, 1)}
+}
+
+func (w *Waiter) WaitForCancel(ctx context.Context, args Args, reply *Reply) error {
+	w.started <- struct{}{}
+	<-ctx.Done()
+	w.cancelled <- ctx.Err()
+	return ctx.Err()
+}
+
+func (t *Arith) Metadata(ctx context.Context, args Args, reply *string) error {
+	md := MetadataFromContext(ctx)
+	*reply = md["token"]
+	SetResponseMetadata(ctx, "trace", md["trace"]+"-done")
+	return nil
+}
+
 func listenTCP() (net.Listener, string) {
 	l, e := net.Listen("tcp", "127.0.0.1:0") // any available address
 	if e != nil {
@@ -150,6 +188,23 @@ func testRPC(t *testing.T, addr string) {
 		t.Error("BadOperation: expected error")
 	} else if !strings.HasPrefix(err.Error(), "rpc: can't find method ") {
 		t.Errorf("BadOperation: expected can't find method error; got %q", err)
+	} else if !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("BadOperation: expected ErrUnknownMethod; got %#v", err)
+	}
+
+	// Nonexistent service
+	err = client.Call("Unknown.Add", args, reply)
+	if !errors.Is(err, ErrUnknownService) {
+		t.Errorf("expected ErrUnknownService; got %#v", err)
+	}
+
+	// Coded error with details
+	err = client.Call("Arith.Checked", &Args{A: 1000}, reply)
+	var rpcErr *Error
+	if !errors.As(err, &rpcErr) {
+		t.Errorf("Checked: expected *Error; got %#v", err)
+	} else if rpcErr.Code != CodeTooLarge || rpcErr.Message != "Checked: too large" || rpcErr.Details["max"] != "100" {
+		t.Errorf("Checked: unexpected error %#v", rpcErr)
 	}
 
 	// Unknown service
@@ -194,6 +249,8 @@ func testRPC(t *testing.T, addr string) {
 		t.Error("Div: expected error")
 	} else if err.Error() != "divide by zero" {
 		t.Error("Div: expected divide by zero error; got", err)
+	} else if _, ok := err.(ServerError); !ok {
+		t.Errorf("Div: expected ServerError; got %#v", err)
 	}
 
 	// Bad type.
@@ -203,6 +260,8 @@ func testRPC(t *testing.T, addr string) {
 		t.Error("expected error calling Arith.Add with wrong arg type")
 	} else if strings.Index(err.Error(), "type") < 0 {
 		t.Error("expected error about type; got", err)
+	} else if !errors.Is(err, ErrBadArgument) {
+		t.Errorf("expected ErrBadArgument; got %#v", err)
 	}
 
 	// Non-struct argument
@@ -246,6 +305,224 @@ func testRPC(t *testing.T, addr string) {
 	}
 }
 
+func TestContextCancelledOnEOF(t *testing.T) {
+	server := NewServer()
+	waiter := newWaiter()
+	server.Register(waiter)
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	client.Go("Waiter.WaitForCancel", &Args{}, new(Reply), nil)
+	select {
+	case <-waiter.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("method was not called")
+	}
+	client.Close()
+	select {
+	case err := <-waiter.cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context was not cancelled after the client hung up")
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	waiter := newWaiter()
+	server.Register(waiter)
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client := NewClient(cli)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.CallContext(ctx, "Waiter.WaitForCancel", &Args{}, new(Reply))
+	// the server's context expires at the same time, and its error may
+	// arrive first
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ServerError(context.DeadlineExceeded.Error())) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	<-waiter.started
+
+	client.mutex.Lock()
+	pending := len(client.pending)
+	client.mutex.Unlock()
+	if pending != 0 {
+		t.Errorf("expected no pending calls, got %d", pending)
+	}
+
+	select {
+	case err := <-waiter.cancelled:
+		if err == nil {
+			t.Error("expected server context to be done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server context was not cancelled")
+	}
+
+	// the connection is still usable
+	reply := new(Reply)
+	if err := client.CallContext(context.Background(), "Arith.Add", &Args{7, 8}, reply); err != nil {
+		t.Fatal("Add:", err)
+	}
+	if reply.C != 15 {
+		t.Errorf("Add: expected 15 got %d", reply.C)
+	}
+}
+
+type Slow int
+
+// Ints replies with a large slice after delay.
+func (t *Slow) Ints(delay time.Duration, reply *[]int) error {
+	time.Sleep(delay)
+	*reply = make([]int, 1<<16)
+	return nil
+}
+
+// blockingCodec holds up the first decoding of a reply until resume is
+// closed.
+type blockingCodec struct {
+	ClientCodec
+	reading chan struct{}
+	resume  chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingCodec) ReadResponseBody(body interface{}) error {
+	if body != nil {
+		c.once.Do(func() {
+			close(c.reading)
+			<-c.resume
+		})
+	}
+	return c.ClientCodec.ReadResponseBody(body)
+}
+
+// TestCallContextAbandonedReply checks that a call abandoned, as when its
+// context is done, while its reply is being decoded is completed once, by
+// either side: run with -race.
+func TestCallContextAbandonedReply(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Slow))
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	codec := &blockingCodec{
+		ClientCodec: newGobClientCodec(cli),
+		reading:     make(chan struct{}),
+		resume:      make(chan struct{}),
+	}
+	client := NewClientWithCodec(codec)
+	defer client.Close()
+
+	var reply []int
+	call := client.Go("Slow.Ints", time.Duration(0), &reply, nil)
+	<-codec.reading
+	client.abandon(call, context.Canceled)
+	close(codec.resume)
+	<-call.Done
+
+	// the reply has been decoded once the next call completes
+	var next []int
+	if err := client.Call("Slow.Ints", time.Duration(0), &next); err != nil {
+		t.Fatal("Ints:", err)
+	}
+	if n := len(call.Done); n != 0 {
+		t.Errorf("call completed %d more times", n)
+	}
+	switch {
+	case errors.Is(call.Error, context.Canceled):
+		if reply != nil {
+			t.Errorf("abandoned call got a reply of %d values", len(reply))
+		}
+	case call.Error != nil:
+		t.Errorf("Ints: %v", call.Error)
+	case len(reply) != 1<<16:
+		t.Errorf("Ints: got %d values", len(reply))
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	once.Do(startServer)
+	client, err := Dial("tcp", serverAddr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+
+	ctx := WithMetadata(context.Background(), map[string]string{"token": "secret"})
+	ctx = WithMetadata(ctx, map[string]string{"trace": "abc"})
+	var reply string
+	call := <-client.GoContext(ctx, "Arith.Metadata", &Args{}, &reply, nil).Done
+	if call.Error != nil {
+		t.Fatal("Metadata:", call.Error)
+	}
+	if reply != "secret" {
+		t.Errorf("Metadata: expected token %q got %q", "secret", reply)
+	}
+	if trace := call.ResponseMetadata["trace"]; trace != "abc-done" {
+		t.Errorf("Metadata: expected trace %q got %q", "abc-done", trace)
+	}
+
+	// metadata is per call
+	call = <-client.Go("Arith.Metadata", &Args{}, &reply, nil).Done
+	if call.Error != nil {
+		t.Fatal("Metadata:", call.Error)
+	}
+	if reply != "" {
+		t.Errorf("Metadata: expected no token, got %q", reply)
+	}
+	if trace := call.ResponseMetadata["trace"]; trace != "-done" {
+		t.Errorf("Metadata: expected trace %q got %q", "-done", trace)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	server := NewServer()
+	server.Register(new(Arith))
+	cli, srv := net.Pipe()
+	entries := make(chan *RequestLogEntry, 10)
+	go server.ServeConn(srv, func(e *RequestLogEntry) { entries <- e })
+
+	client := NewClient(cli)
+	defer client.Close()
+
+	err := client.Call("Arith.Error", &Args{7, 8}, new(Reply))
+	if err == nil {
+		t.Fatal("Error: expected error")
+	}
+	if !strings.HasPrefix(err.Error(), "rpc: panic serving Arith.Error: ERROR") {
+		t.Errorf("Error: expected panic error; got %q", err)
+	}
+	if !errors.Is(err, ErrInternal) {
+		t.Errorf("Error: expected ErrInternal; got %#v", err)
+	}
+	select {
+	case e := <-entries:
+		if e.Panic != "ERROR" {
+			t.Errorf("expected panic value in log entry, got %q", e.Panic)
+		}
+		if !strings.Contains(e.PanicStack, "(*Arith).Error") {
+			t.Errorf("expected stack in log entry, got %q", e.PanicStack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("call was not logged")
+	}
+
+	// the server keeps serving
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{7, 8}, reply); err != nil {
+		t.Fatal("Add:", err)
+	}
+	if reply.C != 15 {
+		t.Errorf("Add: expected 15 got %d", reply.C)
+	}
+}
+
 func TestHTTP(t *testing.T) {
 	once.Do(startServer)
 	testHTTPRPC(t, "")
@@ -450,10 +727,12 @@ func benchmarkEndToEnd(dial func() (*Client, error), b *testing.B) {
 			for atomic.AddInt32(&N, -1) >= 0 {
 				err := client.Call("Arith.Add", args, reply)
 				if err != nil {
-					b.Fatalf("rpc error: Add: expected no error but got string %q", err.Error())
+					b.Errorf("rpc error: Add: expected no error but got string %q", err.Error())
+					break
 				}
 				if reply.C != args.A+args.B {
-					b.Fatalf("rpc error: Add: expected %d got %d", reply.C, args.A+args.B)
+					b.Errorf("rpc error: Add: expected %d got %d", reply.C, args.A+args.B)
+					break
 				}
 			}
 			wg.Done()
@@ -496,7 +775,7 @@ func benchmarkEndToEndAsync(dial func() (*Client, error), b *testing.B) {
 				B := call.Args.(*Args).B
 				C := call.Reply.(*Reply).C
 				if A+B != C {
-					b.Fatalf("incorrect reply: Add: expected %d got %d", A+B, C)
+					b.Errorf("incorrect reply: Add: expected %d got %d", A+B, C)
 				}
 				<-gate
 				if atomic.AddInt32(&recv, -1) == 0 {
@@ -524,3 +803,45 @@ func BenchmarkEndToEndAsync(b *testing.B) {
 func BenchmarkEndToEndAsyncHTTP(b *testing.B) {
 	benchmarkEndToEndAsync(dialHTTP, b)
 }
+
+// flakyListener fails its first Accept calls with errs.
+type flakyListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		return nil, err
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptRetry(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	for _, err := range []error{emfile, syscall.ENFILE, os.ErrDeadlineExceeded} {
+		if !retryAccept(err) {
+			t.Errorf("%v: expected Accept to retry", err)
+		}
+	}
+	if retryAccept(errors.New("accept failed")) {
+		t.Error("expected Accept to give up on other errors")
+	}
+
+	server := NewServer()
+	server.Register(new(Arith))
+	l, addr := listenTCP()
+	defer l.Close()
+	go server.Accept(&flakyListener{Listener: l, errs: []error{emfile, emfile}})
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("Arith.Add", &Args{7, 8}, reply); err != nil || reply.C != 15 {
+		t.Errorf("Add: got %d, %v", reply.C, err)
+	}
+}
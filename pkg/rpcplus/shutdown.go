@@ -0,0 +1,176 @@
+package rpcplus
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// ErrServerShutdown is returned for calls the server refuses or stops
+// because it is shutting down.
+var ErrServerShutdown = NewError(CodeUnavailable, "rpc: server is shutting down")
+
+// A GoAway response, sent when the server starts shutting down, tells the
+// client to stop sending new requests on the connection.  Its sequence
+// number is never used by a client, so older clients discard it.  Codecs
+// that do not send the ServiceMethod of responses carry it in a form of
+// their own, or drop it if their protocol has none: their clients then
+// learn of the shutdown from the ErrServerShutdown errors of new calls.
+const (
+	GoAwayServiceMethod = "GoAway"
+	GoAwaySeq           = ^uint64(0)
+)
+
+// serverConn tracks the calls in flight on a connection so that the server
+// can drain it when shutting down.
+type serverConn struct {
+	codec   ServerCodec
+	sending *sync.Mutex
+	drain   chan struct{} // closed when the connection starts draining
+	idle    chan struct{} // closed once draining with no calls in flight
+
+	mu       sync.Mutex // protects active, draining
+	active   int
+	draining bool
+
+	closeOnce sync.Once
+}
+
+// begin registers a new call, unless the connection is draining.
+func (sc *serverConn) begin() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.active++
+	return true
+}
+
+// end unregisters a call once its last response has been sent.
+func (sc *serverConn) end() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active--
+	if sc.draining && sc.active == 0 {
+		close(sc.idle)
+	}
+}
+
+// startDrain refuses new calls, tells the client to stop sending them and
+// signals the open streams.
+func (sc *serverConn) startDrain(server *Server) {
+	sc.mu.Lock()
+	if sc.draining {
+		sc.mu.Unlock()
+		return
+	}
+	sc.draining = true
+	close(sc.drain)
+	if sc.active == 0 {
+		close(sc.idle)
+	}
+	sc.mu.Unlock()
+
+	req := &Request{ServiceMethod: GoAwayServiceMethod, Seq: GoAwaySeq}
+	if err := server.sendResponse(sc.sending, req, invalidRequest, sc.codec, nil, nil, true); err != nil {
+		log.Println("rpc: cannot send GoAway:", err)
+	}
+}
+
+func (sc *serverConn) close() {
+	sc.closeOnce.Do(func() { sc.codec.Close() })
+}
+
+// trackConn registers a connection being served, or returns nil if the
+// server has been shut down.
+func (server *Server) trackConn(codec ServerCodec, sending *sync.Mutex) *serverConn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.shutdown {
+		return nil
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	sc := &serverConn{
+		codec:   codec,
+		sending: sending,
+		drain:   make(chan struct{}),
+		idle:    make(chan struct{}),
+	}
+	server.conns[sc] = struct{}{}
+	return sc
+}
+
+func (server *Server) untrackConn(sc *serverConn) {
+	server.mu.Lock()
+	delete(server.conns, sc)
+	server.mu.Unlock()
+}
+
+// trackListener adds or removes a listener used by Accept.  It reports
+// false if the listener cannot be added because the server has been shut
+// down.
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.shutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+func (server *Server) isShutdown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.shutdown
+}
+
+// Shutdown gracefully shuts down the server.  It closes the listeners
+// passed to Accept, tells connected clients to stop sending new requests
+// and signals open streams with ErrServerShutdown on Stream.Error.  It then
+// waits for the calls in flight to return before closing each connection.
+//
+// If ctx is done before the connections are drained, Shutdown closes the
+// remaining connections and returns ctx.Err().  Once Shutdown has been
+// called, the server refuses new connections.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.shutdown = true
+	listeners := server.listeners
+	server.listeners = nil
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	for lis := range listeners {
+		lis.Close()
+	}
+	for _, sc := range conns {
+		sc.startDrain(server)
+	}
+	for i, sc := range conns {
+		select {
+		case <-sc.idle:
+			sc.close()
+		case <-ctx.Done():
+			for _, sc := range conns[i:] {
+				sc.close()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package rpcplus
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+type Drainer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *Drainer) Wait(args Args, reply *Reply) error {
+	d.started <- struct{}{}
+	<-d.release
+	reply.C = args.A + args.B
+	return nil
+}
+
+func startDrainer(t *testing.T) (*Server, *Drainer, string, chan struct{}) {
+	d := &Drainer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	server := NewServer()
+	if err := server.Register(d); err != nil {
+		t.Fatal("Register failed", err)
+	}
+	server.Register(new(StreamingArith))
+	l, addr := listenTCP()
+	accepting := make(chan struct{})
+	go func() {
+		server.Accept(l)
+		close(accepting)
+	}()
+	return server, d, addr, accepting
+}
+
+func TestShutdownDrainsCalls(t *testing.T) {
+	server, d, addr, accepting := startDrainer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+
+	reply := new(Reply)
+	call := client.Go("Drainer.Wait", &Args{7, 8}, reply, nil)
+	<-d.started
+
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	select {
+	case <-accepting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return")
+	}
+
+	// wait for the client to be told to stop sending requests
+	for i := 0; ; i++ {
+		client.mutex.Lock()
+		draining := client.draining
+		client.mutex.Unlock()
+		if draining {
+			break
+		}
+		if i == 500 {
+			t.Fatal("client was not told the server is shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := client.Call("Drainer.Wait", &Args{}, new(Reply)); err != ErrShutdown {
+		t.Errorf("expected ErrShutdown for a new call, got %v", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatal("Shutdown returned before the call completed:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(d.release)
+	<-call.Done
+	if call.Error != nil {
+		t.Fatal("Wait:", call.Error)
+	}
+	if reply.C != 15 {
+		t.Errorf("Wait: expected 15 got %d", reply.C)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("Shutdown:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownStopsStreams(t *testing.T) {
+	server, _, addr, _ := startDrainer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+
+	rowChan := make(chan *StreamingReply, 10)
+	c := client.StreamGo("StreamingArith.Thrive", &StreamingArgs{3, 100000, -1}, rowChan)
+	<-rowChan
+
+	shutdown := make(chan error)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+
+	for _ = range rowChan {
+	}
+	if c.Error == nil || c.Error.Error() != ErrServerShutdown.Error() {
+		t.Error("expected shutdown error, got", c.Error)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error("Shutdown:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, d, addr, _ := startDrainer(t)
+	defer close(d.release)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+
+	call := client.Go("Drainer.Wait", &Args{}, new(Reply), nil)
+	<-d.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// the connection was closed under the call
+	<-call.Done
+	if call.Error == nil {
+		t.Error("expected an error")
+	}
+
+	// the server refuses new connections
+	conn, err := net.Dial("tcp", addr)
+	if err == nil {
+		conn.Close()
+		t.Error("expected the listener to be closed")
+	}
+}
@@ -1,10 +1,13 @@
 package rpcplus
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -43,6 +46,64 @@ func (t *StreamingArith) Thrive(args StreamingArgs, stream Stream) error {
 	return nil
 }
 
+func (t *StreamingArith) ThriveUntilCancelled(ctx context.Context, args StreamingArgs, stream Stream) error {
+	for i := 0; ; i++ {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *StreamingArith) Panic(args StreamingArgs, stream Stream) error {
+	for i := 0; i < args.Count; i++ {
+		stream.Send <- &StreamingReply{C: args.A, Index: i}
+	}
+	panic("stream panic")
+}
+
+func (t *StreamingArith) Sum(in <-chan *StreamingArgs, reply *StreamingReply) error {
+	for args := range in {
+		reply.C += args.A
+		reply.Index++
+	}
+	return nil
+}
+
+func (t *StreamingArith) Echo(in <-chan *StreamingArgs, stream Stream) error {
+	i := 0
+	for args := range in {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+		case <-stream.Error:
+			return nil
+		}
+		i++
+	}
+	return nil
+}
+
+func (t *StreamingArith) Stalled(ctx context.Context, in <-chan *StreamingArgs, reply *StreamingReply) error {
+	<-ctx.Done()
+	return nil
+}
+
+// streamSent counts the values sent by Counted.
+var streamSent int32
+
+func (t *StreamingArith) Counted(args StreamingArgs, stream Stream) error {
+	for i := 0; i < args.Count; i++ {
+		select {
+		case stream.Send <- &StreamingReply{C: args.A, Index: i}:
+			atomic.AddInt32(&streamSent, 1)
+		case <-stream.Error:
+			return nil
+		}
+	}
+	return nil
+}
+
 // make a server, a cient, and connect them
 func makeLink(t *testing.T) (client *Client) {
 	// start a server
@@ -194,3 +255,256 @@ func TestInterruptedCallByClient(t *testing.T) {
 	// make sure the wire is still in good shape
 	callOnceAndCheck(t, client)
 }
+
+func TestStreamContextCancelledByClient(t *testing.T) {
+	client := makeLink(t)
+	args := &StreamingArgs{3, 0, -1}
+	rowChan := make(chan *StreamingReply, 10)
+	c := client.StreamGo("StreamingArith.ThriveUntilCancelled", args, rowChan)
+	if _, ok := <-rowChan; !ok {
+		t.Fatal("unexpected closed channel")
+	}
+	if err := c.CloseStream(); err != nil {
+		t.Fatal("CloseStream:", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _ = range rowChan {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not stopped by cancelling its context")
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
+
+func TestStreamPanic(t *testing.T) {
+	client := makeLink(t)
+	args := &StreamingArgs{3, 5, -1}
+	rowChan := make(chan *StreamingReply, 10)
+	c := client.StreamGo("StreamingArith.Panic", args, rowChan)
+	count := 0
+	for _ = range rowChan {
+		count++
+	}
+	if count != 5 {
+		t.Fatal("Didn't receive the right number of packets back:", count)
+	}
+	if c.Error == nil || !strings.HasPrefix(c.Error.Error(), "rpc: panic serving StreamingArith.Panic: stream panic") {
+		t.Fatal("expected panic error, got", c.Error)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
+
+func TestClientStream(t *testing.T) {
+	client := makeLink(t)
+	reply := new(StreamingReply)
+	c := client.SendStreamGo("StreamingArith.Sum", reply, nil)
+	for i := 1; i <= 10; i++ {
+		if err := c.Send(&StreamingArgs{A: i}); err != nil {
+			t.Fatal("Send:", err)
+		}
+	}
+	if err := c.CloseSend(); err != nil {
+		t.Fatal("CloseSend:", err)
+	}
+	<-c.Done
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	if reply.C != 55 || reply.Index != 10 {
+		t.Fatalf("Sum: expected 55 from 10 values, got %d from %d", reply.C, reply.Index)
+	}
+	if err := c.Send(&StreamingArgs{A: 1}); err != ErrStreamClosed {
+		t.Fatal("Send after completion: expected ErrStreamClosed, got", err)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
+
+func TestBidiStream(t *testing.T) {
+	client := makeLink(t)
+	rowChan := make(chan *StreamingReply)
+	c := client.BidiStreamGo("StreamingArith.Echo", rowChan)
+	for i := 0; i < 10; i++ {
+		if err := c.Send(&StreamingArgs{A: i * 2}); err != nil {
+			t.Fatal("Send:", err)
+		}
+		row, ok := <-rowChan
+		if !ok {
+			t.Fatal("unexpected closed channel")
+		}
+		if row.C != i*2 || row.Index != i {
+			t.Fatalf("Echo: expected %d at %d, got %d at %d", i*2, i, row.C, row.Index)
+		}
+	}
+	if err := c.CloseSend(); err != nil {
+		t.Fatal("CloseSend:", err)
+	}
+	for _ = range rowChan {
+		t.Fatal("unexpected value after CloseSend")
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
+
+func TestClientStreamOverflow(t *testing.T) {
+	client := makeLink(t)
+	reply := new(StreamingReply)
+	c := client.SendStreamGo("StreamingArith.Stalled", reply, nil)
+	// one value is held by the channel of the method, the others queued
+	for i := 0; i < MaxQueuedArgs+2; i++ {
+		if err := c.Send(&StreamingArgs{A: i}); err == ErrStreamClosed {
+			break
+		} else if err != nil {
+			t.Fatal("Send:", err)
+		}
+	}
+	<-c.Done
+	if !errors.Is(c.Error, ErrResourceExhausted) {
+		t.Fatal("expected the call to fail with CodeResourceExhausted, got", c.Error)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	client := makeLink(t)
+	client.SetStreamWindow(4)
+	atomic.StoreInt32(&streamSent, 0)
+
+	// nobody reads the replies for now
+	args := &StreamingArgs{3, 100, -1}
+	rowChan := make(chan *StreamingReply)
+	c := client.StreamGo("StreamingArith.Counted", args, rowChan)
+
+	// the slow stream does not hold up other calls
+	callOnceAndCheck(t, client)
+
+	// the server waits for credit once the window is used up: the count
+	// of values sent reaches it, and stays there
+	deadline := time.Now().Add(5 * time.Second)
+	for stable := 0; stable < 10; time.Sleep(10 * time.Millisecond) {
+		switch sent := atomic.LoadInt32(&streamSent); {
+		case sent > 4:
+			t.Fatal("server sent more than the window ahead of the reader:", sent)
+		case sent == 4:
+			stable++
+		case time.Now().After(deadline):
+			t.Fatal("server sent only", sent, "values of the window")
+		}
+	}
+
+	count := 0
+	for row := range rowChan {
+		if row.Index != count {
+			t.Fatal("unexpected value:", row.Index)
+		}
+		count++
+	}
+	if c.Error != nil {
+		t.Fatal("unexpected error:", c.Error)
+	}
+	if count != 100 {
+		t.Fatal("Didn't receive the right number of packets back:", count)
+	}
+}
+
+// methodRecorder records the requests written by a client.
+type methodRecorder struct {
+	ClientCodec
+
+	mu      sync.Mutex
+	methods []string
+	windows []uint32
+}
+
+func (c *methodRecorder) WriteRequest(r *Request, body interface{}) error {
+	c.mu.Lock()
+	c.methods = append(c.methods, r.ServiceMethod)
+	c.windows = append(c.windows, r.Window)
+	c.mu.Unlock()
+	return c.ClientCodec.WriteRequest(r, body)
+}
+
+func TestStreamWindowOptIn(t *testing.T) {
+	server := NewServer()
+	server.Register(new(StreamingArith))
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	codec := &methodRecorder{ClientCodec: newGobClientCodec(cli)}
+	client := NewClientWithCodec(codec)
+	defer client.Close()
+
+	// by default, the client neither asks for flow control nor returns
+	// credit, which servers predating it do not understand
+	rowChan := make(chan *StreamingReply)
+	c := client.StreamGo("StreamingArith.Thrive", &StreamingArgs{3, 100, -1}, rowChan)
+	count := 0
+	for range rowChan {
+		count++
+	}
+	if c.Error != nil || count != 100 {
+		t.Fatalf("Thrive: got %d values and error %v", count, c.Error)
+	}
+	codec.mu.Lock()
+	defer codec.mu.Unlock()
+	for i, method := range codec.methods {
+		if method == streamCreditServiceMethod || codec.windows[i] != 0 {
+			t.Errorf("unexpected request %s with window %d", method, codec.windows[i])
+		}
+	}
+}
+
+func TestStreamAbandoned(t *testing.T) {
+	client := makeLink(t)
+	client.SetStreamWindow(4)
+	ctx, cancel := context.WithCancel(context.Background())
+	rowChan := make(chan *StreamingReply)
+	c := client.StreamGoContext(ctx, "StreamingArith.ThriveUntilCancelled", &StreamingArgs{A: 3}, rowChan)
+	if _, ok := <-rowChan; !ok {
+		t.Fatal("unexpected closed channel")
+	}
+
+	// the replies queued meanwhile are dropped, and the channel closed
+	cancel()
+	done := make(chan int)
+	go func() {
+		count := 0
+		for range rowChan {
+			count++
+		}
+		done <- count
+	}()
+	select {
+	case count := <-done:
+		if count > 4 {
+			t.Error("got more than the window after abandoning the call:", count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the channel of an abandoned stream was not closed")
+	}
+	if !errors.Is(c.Error, context.Canceled) {
+		t.Fatal("expected context.Canceled, got", c.Error)
+	}
+
+	// make sure the wire is still in good shape
+	callOnceAndCheck(t, client)
+}
@@ -0,0 +1,131 @@
+package rpcplus
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PeerIdentity is the identity of a client connected with TLS, taken from
+// its verified certificate.  It is the connection context of the
+// connections served by Accept from a TLS listener, and by ServeHTTP over
+// TLS, so that methods can authorize their callers:
+//
+//	func (t *T) MethodName(peer *rpcplus.PeerIdentity, argType T1, replyType *T2) error
+//
+// Methods taking a context.Context get it with PeerFromContext, and
+// interceptors find it in ServerCall.ConnContext.  Methods taking the
+// SetContextType type still receive a new value of that type.
+//
+// The identity is empty if the client sent no certificate, or one that was
+// not verified (see tls.Config.ClientAuth), and methods taking it receive
+// nil over connections without TLS.
+type PeerIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+
+	// Certificate is the verified certificate of the client, nil if none.
+	Certificate *x509.Certificate
+}
+
+// NewPeerIdentity returns the identity of the peer of a TLS connection.
+func NewPeerIdentity(state *tls.ConnectionState) *PeerIdentity {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return &PeerIdentity{}
+	}
+	cert := state.VerifiedChains[0][0]
+	return &PeerIdentity{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Certificate:    cert,
+	}
+}
+
+// connContextKey is the key of the connection context in the context of the
+// calls served on the connection.
+type connContextKey struct{}
+
+// PeerFromContext returns the identity of the TLS client of a call, given
+// the context.Context passed to the method, or nil if the client did not
+// connect with TLS.
+func PeerFromContext(ctx context.Context) *PeerIdentity {
+	peer, _ := ctx.Value(connContextKey{}).(*PeerIdentity)
+	return peer
+}
+
+// ConnContext returns the connection context of the RPC connection
+// hijacked from req: the *PeerIdentity of the client if it connected with
+// TLS, nil otherwise.
+func ConnContext(req *http.Request) interface{} {
+	if req.TLS == nil {
+		return nil
+	}
+	return NewPeerIdentity(req.TLS)
+}
+
+// tlsHandshakeTimeout bounds the handshake of a connection accepted by
+// Accept.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// serveAccepted serves a connection accepted by Accept.  A TLS connection
+// is served once the handshake is done, with the identity of the client as
+// the connection context.
+func (server *Server) serveAccepted(conn net.Conn) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		server.ServeConn(conn)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Print("rpc.Serve: TLS handshake with ", conn.RemoteAddr(), ": ", err)
+		conn.Close()
+		return
+	}
+	state := tlsConn.ConnectionState()
+	server.ServeConnWithContext(conn, NewPeerIdentity(&state))
+}
+
+// ListenTLS listens for TLS connections to serve with Accept.  To know the
+// identity of the clients, config must verify their certificates, for
+// example with ClientAuth set to tls.RequireAndVerifyClientCert and the
+// authorities in ClientCAs.
+func ListenTLS(network, address string, config *tls.Config) (net.Listener, error) {
+	return tls.Listen(network, address, config)
+}
+
+// DialTLS connects to an RPC server at the specified network address with
+// TLS.  For mutual TLS, config holds the certificate of the client.
+func DialTLS(network, address string, config *tls.Config, opts ...DialOption) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	if newDialOptions(opts).compress {
+		return NewClient(NewFlateConn(conn)), nil
+	}
+	return NewClient(conn), nil
+}
+
+// DialHTTPTLS connects to an HTTPS RPC server at the specified network
+// address listening on the default HTTP RPC path.
+func DialHTTPTLS(network, address string, config *tls.Config, opts ...DialOption) (*Client, error) {
+	dial := func(network, address string) (net.Conn, error) {
+		return tls.Dial(network, address, config)
+	}
+	return DialHTTPPath(network, address, DefaultRPCPath, dial, opts...)
+}
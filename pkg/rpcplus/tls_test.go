@@ -0,0 +1,191 @@
+package rpcplus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Auth int
+
+func (t *Auth) Whoami(peer *PeerIdentity, args int, reply *string) error {
+	if peer == nil || peer.Certificate == nil {
+		return errors.New("unauthenticated")
+	}
+	names := []string{peer.Subject.CommonName}
+	names = append(names, peer.DNSNames...)
+	for _, u := range peer.URIs {
+		names = append(names, u.String())
+	}
+	*reply = strings.Join(names, " ")
+	return nil
+}
+
+func (t *Auth) WhoamiContext(ctx context.Context, args int, reply *string) error {
+	return t.Whoami(PeerFromContext(ctx), args, reply)
+}
+
+// Count counts the calls on the connection in its context, of the type set
+// with SetContextType.
+func (t *Auth) Count(calls *int, args int, reply *int) error {
+	*calls++
+	*reply = *calls
+	return nil
+}
+
+// testCert issues a certificate for template, signed by parent, or self-signed
+// if parent is nil.
+func testCert(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testTLSConfigs returns the configurations of a server verifying client
+// certificates and of a client with one, both issued by a test authority.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	ca := testCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	uri, _ := url.Parse("spiffe://flynn/worker")
+	clientCert := testCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		DNSNames:    []string{"alice.example.com"},
+		URIs:        []*url.URL{uri},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+	}
+	return server, client
+}
+
+const alice = "alice alice.example.com spiffe://flynn/worker"
+
+func whoami(t *testing.T, client *Client, want string) {
+	var reply string
+	err := client.Call("Auth.Whoami", 0, &reply)
+	if want == "" {
+		if err == nil || err.Error() != "unauthenticated" {
+			t.Errorf("Whoami: expected unauthenticated, got %q, %v", reply, err)
+		}
+		return
+	}
+	if err != nil || reply != want {
+		t.Errorf("Whoami: expected %q, got %q, %v", want, reply, err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	server := NewServer()
+	server.SetContextType(reflect.TypeOf(0))
+	server.Register(new(Auth))
+
+	l, err := ListenTLS("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := DialTLS("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("dialing:", err)
+	}
+	whoami(t, client, alice)
+	var reply string
+	if err := client.Call("Auth.WhoamiContext", 0, &reply); err != nil || reply != alice {
+		t.Errorf("WhoamiContext: expected %q, got %q, %v", alice, reply, err)
+	}
+	// methods taking the SetContextType type get their own context
+	for i := 1; i <= 2; i++ {
+		var calls int
+		if err := client.Call("Auth.Count", 0, &calls); err != nil || calls != i {
+			t.Errorf("Count: expected %d, got %d, %v", i, calls, err)
+		}
+	}
+	client.Close()
+
+	// without a client certificate
+	anonymous := clientConfig.Clone()
+	anonymous.Certificates = nil
+	client, err = DialTLS("tcp", l.Addr().String(), anonymous)
+	if err != nil {
+		t.Fatal("dialing:", err)
+	}
+	whoami(t, client, "")
+	client.Close()
+
+	// without TLS
+	cli, srv := net.Pipe()
+	go server.ServeConn(srv)
+	client = NewClient(cli)
+	whoami(t, client, "")
+	client.Close()
+}
+
+func TestHTTPS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	server := NewServer()
+	server.Register(new(Auth))
+
+	srv := httptest.NewUnstartedServer(server)
+	srv.TLS = serverConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	client, err := DialHTTPTLS("tcp", srv.Listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("dialing:", err)
+	}
+	whoami(t, client, alice)
+	client.Close()
+}
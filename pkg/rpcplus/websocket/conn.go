@@ -0,0 +1,280 @@
+// Package websocket implements the parts of the WebSocket protocol (RFC
+// 6455) needed to carry rpcplus codecs: the opening handshake, on either
+// side, and a Conn reading and writing the payloads of data messages as a
+// stream of bytes.  Extensions are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrProtocol is returned when the peer breaks the WebSocket protocol.
+var ErrProtocol = errors.New("websocket: protocol error")
+
+// ErrClosed is returned when writing to a closed Conn.
+var ErrClosed = errors.New("websocket: use of closed connection")
+
+// MessageType is the type of the messages written by a Conn.
+type MessageType int
+
+const (
+	BinaryMessage MessageType = iota // the default
+	TextMessage                      // the bytes written must be valid UTF-8
+)
+
+// Opcodes of the frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Status codes sent in close frames.
+const (
+	closeNormal   = 1000
+	closeProtocol = 1002
+)
+
+// maxControlPayload is the largest payload of a control frame.
+const maxControlPayload = 125
+
+// Conn is a WebSocket connection.  Read returns the payloads of the data
+// messages received, one after the other, and answers control frames as
+// they come.  Each Write sends a message.  Conns are safe to read from one
+// goroutine while writing from others.
+type Conn struct {
+	rwc    io.ReadWriteCloser
+	br     *bufio.Reader
+	client bool // clients mask the frames they send
+	proto  string
+
+	rmu       sync.Mutex // protects the fields below, for Read
+	remaining int64      // unread bytes of the current frame
+	masked    bool
+	maskKey   [4]byte
+	maskPos   int
+	readErr   error
+
+	wmu       sync.Mutex // protects the fields below, and writes to rwc
+	msgType   MessageType
+	closeSent bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newConn(rwc io.ReadWriteCloser, br *bufio.Reader, client bool, proto string) *Conn {
+	return &Conn{rwc: rwc, br: br, client: client, proto: proto}
+}
+
+// Subprotocol returns the subprotocol agreed upon during the handshake, or
+// "" if there is none.
+func (c *Conn) Subprotocol() string {
+	return c.proto
+}
+
+// SetMessageType sets the type of the messages sent by Write.
+func (c *Conn) SetMessageType(t MessageType) {
+	c.wmu.Lock()
+	c.msgType = t
+	c.wmu.Unlock()
+}
+
+// Read reads the payload of the data messages received.  It returns io.EOF
+// once the peer has closed the connection.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		maskBytes(p[:n], c.maskKey, c.maskPos)
+		c.maskPos += n
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.readErr = err
+	}
+	return n, err
+}
+
+// nextFrame reads the header of the next frame.  Control frames are read
+// and handled whole, leaving nothing to read.
+func (c *Conn) nextFrame() error {
+	var h [8]byte
+	if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+		return err
+	}
+	fin, opcode := h[0]&0x80 != 0, h[0]&0x0f
+	masked, n := h[1]&0x80 != 0, int64(h[1]&0x7f)
+	if h[0]&0x70 != 0 || masked == c.client {
+		// no extension was negotiated, and only clients mask
+		return c.fail()
+	}
+	switch n {
+	case 126:
+		if _, err := io.ReadFull(c.br, h[:2]); err != nil {
+			return err
+		}
+		n = int64(binary.BigEndian.Uint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, h[:8]); err != nil {
+			return err
+		}
+		if n = int64(binary.BigEndian.Uint64(h[:8])); n < 0 {
+			return c.fail()
+		}
+	}
+	c.masked = masked
+	c.maskPos = 0
+	if masked {
+		if _, err := io.ReadFull(c.br, c.maskKey[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = n
+		return nil
+	case opClose, opPing, opPong:
+	default:
+		return c.fail()
+	}
+	if !fin || n > maxControlPayload {
+		return c.fail()
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return err
+	}
+	if masked {
+		maskBytes(payload, c.maskKey, 0)
+	}
+	switch opcode {
+	case opPing:
+		if err := c.writeFrame(opPong, payload); err != nil && err != ErrClosed {
+			return err
+		}
+	case opClose:
+		// echo the status code, if any, to complete the closing
+		// handshake
+		if len(payload) > 2 {
+			payload = payload[:2]
+		}
+		c.writeClose(payload)
+		return io.EOF
+	}
+	return nil
+}
+
+// fail closes the connection after the peer broke the protocol.
+func (c *Conn) fail() error {
+	c.writeClose(closePayload(closeProtocol))
+	return ErrProtocol
+}
+
+// Write sends p as a single message.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	opcode := byte(opBinary)
+	if c.msgType == TextMessage {
+		opcode = opText
+	}
+	c.wmu.Unlock()
+	if err := c.writeFrame(opcode, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if c.client {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, payload...)
+		maskBytes(buf[start:], key, 0)
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.rwc.Write(buf)
+	return err
+}
+
+// writeClose sends a close frame, unless one has been sent already.
+func (c *Conn) writeClose(payload []byte) {
+	c.writeFrame(opClose, payload)
+}
+
+// Close sends a close frame, unless one has been sent already, and closes
+// the underlying connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeClose(closePayload(closeNormal))
+		c.closeErr = c.rwc.Close()
+	})
+	return c.closeErr
+}
+
+func closePayload(code uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, code)
+}
+
+// maskBytes applies the mask key to b, the bytes of a payload starting at
+// pos.  Masking twice restores the original bytes.
+func maskBytes(b []byte, key [4]byte, pos int) {
+	for i := range b {
+		b[i] ^= key[(pos+i)&3]
+	}
+}
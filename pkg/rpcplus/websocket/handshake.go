@@ -0,0 +1,255 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// acceptGUID is appended to the key of the client to compute the accept
+// key of the server.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether the comma-separated list of tokens in
+// header h contains token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerList returns the comma-separated list of tokens in header h.
+func headerList(h http.Header, name string) []string {
+	var list []string
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				list = append(list, t)
+			}
+		}
+	}
+	return list
+}
+
+// IsUpgrade reports whether req asks to open a WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	return req.Method == "GET" &&
+		headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// Subprotocols returns the subprotocols offered by the client in req, in
+// its order of preference.
+func Subprotocols(req *http.Request) []string {
+	return headerList(req.Header, "Sec-Websocket-Protocol")
+}
+
+// CheckSameOrigin reports whether the Origin header of req, set by
+// browsers, names the host req is sent to.  Requests without one, from
+// clients other than browsers, are accepted.
+func CheckSameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// An Upgrader completes the opening handshakes of WebSockets.
+type Upgrader struct {
+	// Subprotocols are those supported by the server: the subprotocol
+	// of a WebSocket is the first one offered by the client that is
+	// supported, if any.
+	Subprotocols []string
+
+	// CheckOrigin reports whether to accept a handshake, given the
+	// Origin header of the request.  Since browsers send the cookies of
+	// the server with handshakes from any page, the default,
+	// CheckSameOrigin, only accepts those from the pages of the server.
+	CheckOrigin func(req *http.Request) bool
+}
+
+// Upgrade completes the opening handshake of the WebSocket requested by
+// req with an Upgrader supporting subprotocols.
+func Upgrade(w http.ResponseWriter, req *http.Request, subprotocols []string) (*Conn, error) {
+	u := &Upgrader{Subprotocols: subprotocols}
+	return u.Upgrade(w, req)
+}
+
+// Upgrade completes the opening handshake of the WebSocket requested by
+// req and takes over its connection.  If the request is not a valid
+// WebSocket handshake, or from an origin that is not accepted, Upgrade
+// replies with an HTTP error and returns an error.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	if !IsUpgrade(req) {
+		http.Error(w, "400 must upgrade to websocket", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		w.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(w, "426 unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	if k, err := base64.StdEncoding.DecodeString(key); err != nil || len(k) != 16 {
+		http.Error(w, "400 invalid websocket key", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = CheckSameOrigin
+	}
+	if !checkOrigin(req) {
+		http.Error(w, "403 origin not allowed", http.StatusForbidden)
+		return nil, errors.New("websocket: origin not allowed: " + req.Header.Get("Origin"))
+	}
+	proto := selectSubprotocol(Subprotocols(req), u.Subprotocols)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 cannot hijack connection", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not implement http.Hijacker")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if proto != "" {
+		resp += "Sec-WebSocket-Protocol: " + proto + "\r\n"
+	}
+	if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false, proto), nil
+}
+
+// selectSubprotocol returns the first subprotocol offered that is
+// supported, or "".
+func selectSubprotocol(offered, supported []string) string {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// NewClient performs the opening handshake of the WebSocket at u on conn,
+// offering the given subprotocols, and sending header with the request.
+func NewClient(conn io.ReadWriteCloser, u *url.URL, subprotocols []string, header http.Header) (*Conn, error) {
+	var k [16]byte
+	if _, err := rand.Read(k[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(k[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if len(subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(subprotocols, ", "))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("websocket: unexpected HTTP response: " + resp.Status)
+	}
+	if !headerContains(resp.Header, "Upgrade", "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return nil, errors.New("websocket: invalid handshake response")
+	}
+	proto := resp.Header.Get("Sec-Websocket-Protocol")
+	if proto != "" && selectSubprotocol([]string{proto}, subprotocols) == "" {
+		return nil, fmt.Errorf("websocket: unexpected subprotocol %q", proto)
+	}
+	return newConn(conn, br, true, proto), nil
+}
+
+// Dial opens a WebSocket to rawurl, a ws or wss URL.  See NewClient.
+func Dial(rawurl string, subprotocols []string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", addr)
+	case "wss":
+		conn, err = tls.Dial("tcp", addr, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, u, subprotocols, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoServer echoes the bytes received on WebSockets, in messages of the
+// same sizes.
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := Upgrade(w, req, []string{"echo"})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1<<17)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestEcho(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	conn, err := Dial("ws"+strings.TrimPrefix(srv.URL, "http"), []string{"other", "echo"}, nil)
+	if err != nil {
+		t.Fatal("Dial:", err)
+	}
+	defer conn.Close()
+	if p := conn.Subprotocol(); p != "echo" {
+		t.Errorf("unexpected subprotocol %q", p)
+	}
+
+	// payload lengths of each encoding
+	for _, n := range []int{0, 1, 125, 126, 1 << 16} {
+		msg := bytes.Repeat([]byte{'x'}, n)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal("Write:", err)
+		}
+		if n == 0 {
+			continue
+		}
+		got := make([]byte, n)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("%d bytes: %s", n, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Errorf("%d bytes: unexpected echo", n)
+		}
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	cli, srv := net.Pipe()
+	client := newConn(cli, bufio.NewReader(cli), true, "")
+	server := newConn(srv, bufio.NewReader(srv), false, "")
+
+	// a ping between two messages is answered with a pong
+	go func() {
+		server.Write([]byte("ab"))
+		server.writeFrame(opPing, []byte("hi"))
+		server.Write([]byte("cd"))
+		server.Close()
+	}()
+	pong := make(chan string, 1)
+	go func() {
+		var frame [8]byte
+		io.ReadFull(server.br, frame[:])
+		maskBytes(frame[6:], [4]byte(frame[2:6]), 0)
+		if frame[0] != 0x80|opPong {
+			pong <- ""
+		} else {
+			pong <- string(frame[6:])
+		}
+		io.Copy(io.Discard, server.br)
+	}()
+	got, err := io.ReadAll(client)
+	if err != nil || string(got) != "abcd" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if p := <-pong; p != "hi" {
+		t.Errorf("unexpected pong %q", p)
+	}
+	client.Close()
+}
+
+func TestUnmaskedClientFrame(t *testing.T) {
+	cli, srv := net.Pipe()
+	server := newConn(srv, bufio.NewReader(srv), false, "")
+	go cli.Write([]byte{0x80 | opBinary, 0x01, 'x'})
+	go io.Copy(io.Discard, cli)
+	if _, err := server.Read(make([]byte, 1)); err != ErrProtocol {
+		t.Fatalf("expected protocol error, got %v", err)
+	}
+	server.Close()
+}
+
+func TestCloseStatus(t *testing.T) {
+	cli, srv := net.Pipe()
+	client := newConn(cli, bufio.NewReader(cli), true, "")
+	server := newConn(srv, bufio.NewReader(srv), false, "")
+	defer client.Close()
+	defer server.Close()
+
+	go client.writeClose(closePayload(closeNormal))
+	reply := make(chan []byte, 1)
+	go func() {
+		frame := make([]byte, 4)
+		io.ReadFull(client.br, frame)
+		reply <- frame
+	}()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	// the reply echoes the status code of the client
+	if frame := <-reply; frame[0] != 0x80|opClose || binary.BigEndian.Uint16(frame[2:]) != closeNormal {
+		t.Errorf("unexpected close frame % x", frame)
+	}
+	if _, err := server.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("expected ErrClosed writing after the close, got %v", err)
+	}
+}
+
+func TestUpgradeErrors(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain GET: unexpected status %s", resp.Status)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("old version: unexpected response %s", resp.Status)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// a page of another site
+	header := http.Header{"Origin": {"http://evil.example"}}
+	if _, err := Dial(url, nil, header); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("cross-origin: expected 403, got %v", err)
+	}
+
+	// a page of the server
+	header.Set("Origin", srv.URL)
+	conn, err := Dial(url, nil, header)
+	if err != nil {
+		t.Fatal("same origin:", err)
+	}
+	conn.Close()
+
+	// an Upgrader accepting any origin
+	upgrader := &Upgrader{CheckOrigin: func(req *http.Request) bool { return true }}
+	lax := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if conn, err := upgrader.Upgrade(w, req); err == nil {
+			conn.Close()
+		}
+	}))
+	defer lax.Close()
+	header.Set("Origin", "http://evil.example")
+	conn, err = Dial("ws"+strings.TrimPrefix(lax.URL, "http"), nil, header)
+	if err != nil {
+		t.Fatal("CheckOrigin:", err)
+	}
+	conn.Close()
+}